@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const accessCallback = "access"
+
+// accessRequest is a pending request for access, with the messages sent to the
+// admins, so their buttons are removed once one of them decides.
+type accessRequest struct {
+	messages []tgbotapi.Message
+}
+
+var (
+	accessRequests      = make(map[int64]*accessRequest)
+	accessDenied        = make(map[int64]time.Time) // end of the cooldown after a denial
+	accessRequestsMutex sync.Mutex
+)
+
+func init() {
+	callbackHandlers[accessCallback] = handleAccessCallback
+	// users without access press the request button
+	publicCallbacks[accessCallback] = true
+}
+
+// notAllowedMessage tells the user about missing access and offers to request it.
+func notAllowedMessage(chatID, userID int64) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("You are not allowed to use this bot. User ID: %d", userID))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Request access", callbackData(accessCallback, "request")),
+	))
+	return msg
+}
+
+// handleAccessCallback handles "access:request" pressed by a user and
+// "access:approve:<id>" or "access:deny:<id>" pressed by an admin.
+func handleAccessCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args string) string {
+	action, arg, _ := strings.Cut(args, ":")
+	if action == "request" {
+		if query.Message == nil {
+			return ""
+		}
+		return requestAccess(bot, query.Message, query.From)
+	}
+
+	if !isAdmin(query.From.ID) {
+		return "action not allowed"
+	}
+
+	userID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return "unknown request"
+	}
+
+	switch action {
+	case "approve":
+		return decideAccess(bot, query, userID, true)
+	case "deny":
+		return decideAccess(bot, query, userID, false)
+	}
+	return ""
+}
+
+// requestAccess sends the request of the user with Approve and Deny buttons to the admins.
+func requestAccess(bot *tgbotapi.BotAPI, m *tgbotapi.Message, from *tgbotapi.User) string {
+	userID := from.ID
+	switch err := authorize(userID, m.Chat.ID, capChat); {
+	case err == nil:
+		return "You already have access"
+	case errors.Is(err, errBanned):
+		return "action not allowed"
+	}
+
+	admins := adminIDs()
+	if len(admins) == 0 {
+		return "There are no admins to ask"
+	}
+
+	// the request is reserved, so admins are messaged without holding the lock
+	request := &accessRequest{}
+	accessRequestsMutex.Lock()
+	if _, ok := accessRequests[userID]; ok {
+		accessRequestsMutex.Unlock()
+		return "Your request is waiting for an admin"
+	}
+	if until, ok := accessDenied[userID]; ok {
+		if time.Now().Before(until) {
+			accessRequestsMutex.Unlock()
+			return "Your request was denied, try again later"
+		}
+		delete(accessDenied, userID)
+	}
+	accessRequests[userID] = request
+	accessRequestsMutex.Unlock()
+
+	text := fmt.Sprintf("Access request from %s", describeUser(from))
+	if m.Chat.ID != userID {
+		text += fmt.Sprintf(" in the chat %q (%d)", m.Chat.Title, m.Chat.ID)
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", callbackData(accessCallback, "approve", strconv.FormatInt(userID, 10))),
+		tgbotapi.NewInlineKeyboardButtonData("Deny", callbackData(accessCallback, "deny", strconv.FormatInt(userID, 10))),
+	))
+
+	var messages []tgbotapi.Message
+	for _, admin := range admins {
+		msg := tgbotapi.NewMessage(admin, text)
+		msg.ReplyMarkup = keyboard
+		sent, err := bot.Send(msg)
+		if err != nil {
+			log.Printf("Error sending access request to %d: %v", admin, err)
+			continue
+		}
+		messages = append(messages, sent)
+	}
+
+	accessRequestsMutex.Lock()
+	// an admin may have decided already, then the request is gone
+	decided := accessRequests[userID] != request
+	if len(messages) == 0 && !decided {
+		delete(accessRequests, userID)
+	}
+	request.messages = messages
+	accessRequestsMutex.Unlock()
+	if len(messages) == 0 {
+		return "Could not reach the admins, try again later"
+	}
+	if decided {
+		return "Request sent to the admins"
+	}
+
+	edit := tgbotapi.NewEditMessageText(m.Chat.ID, m.MessageID, m.Text+"\n\nAccess requested, you will be notified.")
+	if _, err := bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+	return "Request sent to the admins"
+}
+
+// decideAccess allows the user or denies the request, then notifies the
+// requester and removes the buttons from the messages of all admins.
+func decideAccess(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, userID int64, approve bool) string {
+	accessRequestsMutex.Lock()
+	request, ok := accessRequests[userID]
+	delete(accessRequests, userID)
+	if approve {
+		delete(accessDenied, userID)
+	} else {
+		accessDenied[userID] = time.Now().Add(time.Duration(cfg.AccessRequestCooldownSeconds) * time.Second)
+	}
+	var messages []tgbotapi.Message
+	if ok {
+		messages = request.messages
+	}
+	accessRequestsMutex.Unlock()
+
+	// the bot was restarted since the request, or the messages are still being
+	// sent, only this message is known
+	if len(messages) == 0 && query.Message != nil {
+		messages = []tgbotapi.Message{*query.Message}
+	}
+
+	result, notice := "Denied", "Your access request was denied."
+	if approve {
+		if err := allowUser(userID); err != nil {
+			log.Printf("error allowing %d: %v", userID, err)
+			return fmt.Sprintf("error: %s", err.Error())
+		}
+		result, notice = "Approved", "Your access request was approved, send /help to start."
+	}
+
+	if err := send(bot, tgbotapi.NewMessage(userID, notice)); err != nil {
+		log.Print(err.Error())
+	}
+
+	for _, m := range messages {
+		edit := tgbotapi.NewEditMessageText(m.Chat.ID, m.MessageID, fmt.Sprintf("%s\n\n%s by %s", m.Text, result, describeUser(query.From)))
+		if _, err := bot.Send(edit); err != nil {
+			log.Printf("Error editing message: %v", err)
+		}
+	}
+
+	log.Printf("access of %d %s by %d", userID, strings.ToLower(result), query.From.ID)
+	return "Request " + strings.ToLower(result)
+}
+
+// allowUser assigns the user role to the user and saves the config.
+func allowUser(userID int64) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	setRole(userID, roleUser)
+	return saveConfig()
+}
+
+// describeUser formats the name, username and ID of the user.
+func describeUser(u *tgbotapi.User) string {
+	s := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if u.UserName != "" {
+		s += " (@" + u.UserName + ")"
+	}
+	if u.LanguageCode != "" {
+		s += ", language " + u.LanguageCode
+	}
+	return fmt.Sprintf("%s, ID %d", s, u.ID)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"chatgptbot/pkg/openai"
+)
+
+// openAIPool holds OPENAI_API_KEY and the APIKeys of config.cfg.
+var openAIPool *openai.CredentialPool
+
+func newCredentialPool() *openai.CredentialPool {
+	pool := openai.NewCredentialPool(cfg.OpenAIKeySelection, openai.Credential{
+		Name: "OPENAI_API_KEY",
+		Key:  os.Getenv("OPENAI_API_KEY"),
+	})
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	for _, c := range config.APIKeys {
+		pool.Add(c)
+	}
+	return pool
+}
+
+// handleAPIKeysCommand shows the usage of the API keys since the start.
+func handleAPIKeysCommand() string {
+	var b strings.Builder
+	for _, s := range openAIPool.Stats() {
+		fmt.Fprintf(&b, "%s: %d requests, %d failed, %d running, %d prompt and %d completion tokens",
+			s.Name, s.Requests, s.Failures, s.InFlight, s.PromptTokens, s.CompletionTokens)
+		if !s.SidelinedUntil.IsZero() {
+			fmt.Fprintf(&b, "\n  not used for %s: %s", untilReset(time.Now(), s.SidelinedUntil), s.LastError)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
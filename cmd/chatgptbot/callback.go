@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/MasterDimmy/zipologger"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// callbackHandler handles a press of an inline keyboard button. args is the
+// button data after the handler prefix. The returned text is shown to the user
+// as a notification, it may be empty.
+type callbackHandler func(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args string) string
+
+// callbackHandlers are keyed by the prefix of the button data, "prefix:args".
+var callbackHandlers = map[string]callbackHandler{}
+
+// publicCallbacks are prefixes of handlers which are called for users without
+// access as well. The handlers check permissions themselves.
+var publicCallbacks = map[string]bool{}
+
+// callbackData builds the data of an inline keyboard button for the handler.
+// Telegram limits it to 64 bytes.
+func callbackData(prefix string, args ...string) string {
+	return strings.Join(append([]string{prefix}, args...), ":")
+}
+
+func handleCallbackQuery(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	log := zipologger.NewLogger("./logs/user_"+query.From.UserName+".log", 10, 10, 10, false)
+	log.Printf("=> callback %s", query.Data)
+
+	var text string
+	prefix, args, _ := strings.Cut(query.Data, ":")
+	if query.Message != nil && !publicCallbacks[prefix] && authorize(query.From.ID, query.Message.Chat.ID, capChat) != nil {
+		text = "action not allowed"
+	} else if handler, ok := callbackHandlers[prefix]; ok {
+		text = handler(bot, query, args)
+	} else {
+		log.Printf("unknown callback %s", query.Data)
+	}
+
+	// the button keeps showing a progress indicator until the query is answered
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		log.Printf("Error answering callback: %v", err)
+	}
+}
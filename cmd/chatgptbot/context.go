@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/tokenizer"
+	"chatgptbot/pkg/usage"
+)
+
+// Context trim modes: drop the oldest turns or replace them with a summary.
+const (
+	trimModeDrop      = "drop"
+	trimModeSummarize = "summarize"
+)
+
+// contextTrim tells how the history was trimmed to fit the context window.
+type contextTrim int
+
+const (
+	trimNone       contextTrim = iota
+	trimDropped                // the oldest turns were dropped
+	trimSummarized             // the oldest turns were folded into the summary
+)
+
+// maxSummaryTokens limits the length of the running summary.
+const maxSummaryTokens = 500
+
+// encoding counts prompt tokens. It is nil when no rank file is configured,
+// then token counts are estimated.
+var encoding *tokenizer.Encoding
+
+// fitContext trims the user history to fit the model context window. In the
+// summarize mode dropped turns are folded into the running summary.
+// Must be called with user.mutex held.
+func fitContext(user *User, model string) contextTrim {
+	trimmed := trimNone
+	for {
+		var dropped []openai.ChatCompletionMessage
+		user.HistoryMessage, dropped = trimHistory(model, user.contextMessages(), user.HistoryMessage)
+		if len(dropped) == 0 {
+			return trimmed
+		}
+
+		if cfg.ContextTrimMode != trimModeSummarize {
+			return trimDropped
+		}
+
+		summary, used, err := summarizeHistory(model, user.Summary, dropped)
+		if err != nil {
+			// the turns are lost, not summarized
+			log.Printf("error summarizing context of %d: %v", user.TelegramID, err)
+			return trimDropped
+		}
+		trimmed = trimSummarized
+		// charged to the session, the user lock is already held
+		recordUsage(usage.Record{
+			UserID:           user.TelegramID,
+			Model:            model,
+			PromptTokens:     used.PromptTokens,
+			CompletionTokens: used.CompletionTokens,
+		})
+		user.addTokens(used.TotalTokens)
+		tokensTotal.Add(float64(used.PromptTokens), model, "prompt")
+		tokensTotal.Add(float64(used.CompletionTokens), model, "completion")
+		// the summary may grow, so the history is checked again
+		user.Summary = summary
+	}
+}
+
+// trimHistory drops the oldest turns of history until the prompt fits into the
+// model context window minus the tokens reserved for the completion. System
+// messages and the latest prompt are never dropped.
+func trimHistory(model string, prefix, history []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, []openai.ChatCompletionMessage) {
+	budget := tokenizer.ContextWindow(model) - cfg.CompletionTokenReserve - tokenizer.CountMessages(encoding, model, prefix)
+
+	var dropped []openai.ChatCompletionMessage
+	for tokenizer.CountMessages(encoding, model, history) > budget {
+		start, end := oldestTurn(history)
+		if start < 0 {
+			break
+		}
+		dropped = append(dropped, history[start:end]...)
+		history = append(history[:start:start], history[end:]...)
+	}
+
+	return history, dropped
+}
+
+// oldestTurn returns the bounds of the oldest non-system user message and the
+// answers that follow it, or -1 if only the latest prompt is left.
+func oldestTurn(messages []openai.ChatCompletionMessage) (int, int) {
+	start := -1
+	for i, m := range messages {
+		if m.Role != openai.ChatMessageRoleSystem {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start == len(messages)-1 {
+		return -1, -1
+	}
+
+	end := start + 1
+	for end < len(messages)-1 && messages[end].Role != openai.ChatMessageRoleUser && messages[end].Role != openai.ChatMessageRoleSystem {
+		end++
+	}
+	return start, end
+}
+
+// summarizeHistory asks the model to merge the dropped messages into the summary.
+func summarizeHistory(model, summary string, dropped []openai.ChatCompletionMessage) (string, openai.Usage, error) {
+	var conversation strings.Builder
+	if summary != "" {
+		conversation.WriteString("Summary so far:\n")
+		conversation.WriteString(summary)
+		conversation.WriteString("\n\n")
+	}
+	conversation.WriteString("New messages:\n")
+	for _, m := range dropped {
+		conversation.WriteString(m.Role)
+		conversation.WriteString(": ")
+		conversation.WriteString(m.Content)
+		conversation.WriteString("\n")
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: maxSummaryTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role: openai.ChatMessageRoleSystem,
+				Content: "You maintain a running summary of a conversation between a user and an assistant. " +
+					"Update the summary with the new messages. Keep names, facts, decisions and open questions, " +
+					"be concise and write in the language of the conversation. Reply with the summary only.",
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: conversation.String(),
+			},
+		},
+	}
+
+	resp, err := openAIClient.CreateChatCompletion(requestCtx, req)
+	if err != nil {
+		return "", resp.Usage, err
+	}
+	if len(resp.Choices) == 0 {
+		return summary, resp.Usage, nil
+	}
+
+	return strings.TrimSpace(resp.Choices[0].Message.Content), resp.Usage, nil
+}
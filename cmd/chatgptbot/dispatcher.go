@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// dispatcher fans updates out to per-chat workers. Updates of one chat are
+// handled in the order they were received, while different chats are served
+// concurrently, with at most limit handlers running at the same time.
+type dispatcher struct {
+	handle func(tgbotapi.Update)
+	limit  chan struct{}
+
+	mutex  sync.Mutex
+	queues map[int64][]tgbotapi.Update // pending updates of chats with a running worker
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(limit int, handle func(tgbotapi.Update)) *dispatcher {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &dispatcher{
+		handle: handle,
+		limit:  make(chan struct{}, limit),
+		queues: make(map[int64][]tgbotapi.Update),
+	}
+}
+
+// dispatch queues the update to the worker of its chat, starting one if needed.
+func (d *dispatcher) dispatch(update tgbotapi.Update) {
+	key := updateChatKey(update)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	queue, running := d.queues[key]
+	d.queues[key] = append(queue, update)
+	if running {
+		return
+	}
+
+	d.wg.Add(1)
+	go d.work(key)
+}
+
+// work handles queued updates of the chat until the queue is empty.
+func (d *dispatcher) work(key int64) {
+	defer d.wg.Done()
+
+	for {
+		d.mutex.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mutex.Unlock()
+			return
+		}
+		update := queue[0]
+		d.queues[key] = queue[1:]
+		d.mutex.Unlock()
+
+		d.limit <- struct{}{}
+		d.handle(update)
+		<-d.limit
+	}
+}
+
+// pending returns the number of updates waiting for a handler.
+func (d *dispatcher) pending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var n int
+	for _, queue := range d.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// wait waits for the queued updates to be handled, at most for the timeout.
+// It reports whether all of them were handled.
+func (d *dispatcher) wait(timeout time.Duration) bool {
+	return waitTimeout(&d.wg, timeout)
+}
+
+// waitTimeout waits for the wait group at most for the timeout. It reports
+// whether the wait group is done.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// updateChatKey returns the ID of the chat the update belongs to, falling back
+// to the sender ID for updates without a chat.
+func updateChatKey(update tgbotapi.Update) int64 {
+	if chat := update.FromChat(); chat != nil {
+		return chat.ID
+	}
+	if from := update.SentFrom(); from != nil {
+		return from.ID
+	}
+	return 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"chatgptbot/pkg/markdown"
+	"chatgptbot/pkg/openai"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const restoreCallback = "restore"
+
+const contextClearedNote = "Context cleared due to inactivity."
+
+// expiredContext is a conversation cleared for inactivity. It is kept for
+// CONVERSATION_RESTORE_SECONDS, so the user can restore it.
+type expiredContext struct {
+	history []openai.ChatCompletionMessage
+	summary string
+	until   time.Time
+
+	// message with the restore button, 0 if none was sent
+	chatID    int64
+	messageID int
+}
+
+// lastMessage is the last answer the bot sent in a session. Other messages
+// are not recorded, they may have buttons the note would replace.
+type lastMessage struct {
+	chatID    int64
+	id        int
+	text      string
+	parseMode string
+}
+
+var (
+	lastMessages      = make(map[int64]lastMessage)
+	lastMessagesMutex sync.Mutex
+)
+
+func init() {
+	callbackHandlers[restoreCallback] = handleRestoreCallback
+}
+
+// rememberMessage records the last answer of the session sent to the chat,
+// with the parse mode of the text.
+func rememberMessage(sessionID, chatID int64, messageID int, text, parseMode string) {
+	lastMessagesMutex.Lock()
+	defer lastMessagesMutex.Unlock()
+
+	lastMessages[sessionID] = lastMessage{chatID: chatID, id: messageID, text: text, parseMode: parseMode}
+}
+
+func takeLastMessage(sessionID int64) (lastMessage, bool) {
+	lastMessagesMutex.Lock()
+	defer lastMessagesMutex.Unlock()
+
+	m, ok := lastMessages[sessionID]
+	delete(lastMessages, sessionID)
+	return m, ok
+}
+
+// checkIdleSession clears the conversation of the idle user and notifies the
+// user, then drops conversations which can't be restored anymore. Busy users
+// are skipped, a request is in progress, so they are active.
+func checkIdleSession(bot *tgbotapi.BotAPI, user *User) {
+	if !user.mutex.TryLock() {
+		return
+	}
+	cleared := clearUserContextIfExpires(user)
+	var chatID int64
+	var messageID int
+	if !cleared && user.expired != nil && time.Now().After(user.expired.until) {
+		chatID, messageID = user.expired.chatID, user.expired.messageID
+		user.expired = nil
+	}
+	user.mutex.Unlock()
+
+	if cleared && cfg.NotifyUserOnConversationIdleTimeout {
+		notifyContextCleared(bot, user)
+	}
+	if messageID != 0 {
+		removeKeyboard(bot, chatID, messageID)
+	}
+}
+
+// notifyContextCleared appends a note to the last answer in the session, or
+// sends a silent message to the chat of the conversation if it can't be
+// edited, with a button restoring the conversation.
+func notifyContextCleared(bot *tgbotapi.BotAPI, user *User) {
+	user.mutex.Lock()
+	chatID := user.ChatID
+	user.mutex.Unlock()
+	// sessions saved before chats were recorded are private ones
+	if chatID == 0 {
+		chatID = user.TelegramID
+	}
+
+	var keyboard *tgbotapi.InlineKeyboardMarkup
+	if cfg.ConversationRestoreSeconds > 0 {
+		markup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Restore previous conversation", callbackData(restoreCallback)),
+		))
+		keyboard = &markup
+	}
+
+	var (
+		sent   tgbotapi.Message
+		err    error
+		edited bool
+	)
+	last, ok := takeLastMessage(user.TelegramID)
+	if ok {
+		chatID = last.chatID
+	}
+	note := contextClearedNote
+	if last.parseMode == tgbotapi.ModeHTML {
+		note = markdown.Escape(note)
+	}
+	// the limit counts the text without markup, so this is conservative for HTML
+	if text := last.text + "\n\n" + note; ok && last.text != "" && markdown.Len(text) <= telegramMessageLimit {
+		edit := tgbotapi.NewEditMessageText(chatID, last.id, text)
+		edit.ParseMode = last.parseMode
+		edit.ReplyMarkup = keyboard
+		sent, err = bot.Send(edit)
+		edited = err == nil
+	}
+	if !edited {
+		msg := tgbotapi.NewMessage(chatID, contextClearedNote)
+		msg.DisableNotification = true
+		if keyboard != nil {
+			msg.ReplyMarkup = *keyboard
+		}
+		sent, err = bot.Send(msg)
+	}
+	if err != nil {
+		log.Printf("error notifying %d of cleared context: %v", chatID, err)
+		return
+	}
+
+	user.mutex.Lock()
+	if user.expired != nil {
+		user.expired.chatID, user.expired.messageID = chatID, sent.MessageID
+	}
+	user.mutex.Unlock()
+}
+
+// handleRestoreCallback puts the expired conversation back before the current one.
+func handleRestoreCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args string) string {
+	if query.Message == nil {
+		return ""
+	}
+
+	user := acquireUser(sessionKey(query.Message.Chat, query.From))
+	expired := user.expired
+	restored := expired != nil && time.Now().Before(expired.until)
+	if restored {
+		user.HistoryMessage = append(expired.history, user.HistoryMessage...)
+		if user.Summary == "" {
+			user.Summary = expired.summary
+		}
+		user.expired = nil
+		saveUser(user)
+	}
+	user.mutex.Unlock()
+
+	removeKeyboard(bot, query.Message.Chat.ID, query.Message.MessageID)
+
+	if !restored {
+		return "The previous conversation is no longer available"
+	}
+	return "Previous conversation restored"
+}
+
+func removeKeyboard(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
+	edit := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+	if _, err := bot.Request(edit); err != nil {
+		log.Printf("Error removing keyboard: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Group context modes: every member has their own conversation, the same as
+// in the private chat with the bot, or the group shares one conversation.
+const (
+	groupContextUser  = "user"
+	groupContextGroup = "group"
+)
+
+func isGroupChat(chat *tgbotapi.Chat) bool {
+	return chat != nil && (chat.IsGroup() || chat.IsSuperGroup())
+}
+
+// sessionKey returns the ID of the conversation the message belongs to.
+func sessionKey(chat *tgbotapi.Chat, from *tgbotapi.User) int64 {
+	if isGroupChat(chat) && cfg.GroupContext == groupContextGroup {
+		return chat.ID
+	}
+	return from.ID
+}
+
+// addressedToBot reports whether the bot should respond to the message. In
+// groups the bot responds to commands, mentions and replies to its messages
+// only. The mention is removed from the prompt.
+func addressedToBot(bot *tgbotapi.BotAPI, m *tgbotapi.Message) bool {
+	if !isGroupChat(m.Chat) {
+		return true
+	}
+
+	if m.IsCommand() {
+		// commands like /help@otherbot are addressed to other bots
+		command := m.CommandWithAt()
+		at := strings.Index(command, "@")
+		return at < 0 || strings.EqualFold(command[at+1:], bot.Self.UserName)
+	}
+
+	mentioned := bot.IsMessageToMe(*m) || strings.Contains(m.Caption, "@"+bot.Self.UserName)
+	replied := m.ReplyToMessage != nil && m.ReplyToMessage.From != nil && m.ReplyToMessage.From.ID == bot.Self.ID
+	if !mentioned && !replied {
+		return false
+	}
+
+	m.Text = stripMention(bot, m.Text)
+	m.Caption = stripMention(bot, m.Caption)
+	return true
+}
+
+// stripMention removes mentions of the bot from the text.
+func stripMention(bot *tgbotapi.BotAPI, text string) string {
+	if bot.Self.UserName == "" {
+		return text
+	}
+	re := regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(bot.Self.UserName) + `\b[,:]?`)
+	return strings.TrimSpace(re.ReplaceAllString(text, ""))
+}
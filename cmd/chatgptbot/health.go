@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pollStallTimeout is how long polling may go without a successful getUpdates
+	// before the bot is considered stuck. A long poll takes up to a minute.
+	pollStallTimeout = 3 * time.Minute
+	// openAIProbeInterval is how often readiness checks call the API when
+	// the bot itself did not call it.
+	openAIProbeInterval = time.Minute
+)
+
+// healthState collects the results of requests to Telegram and OpenAI.
+type healthState struct {
+	mutex sync.Mutex
+
+	receiving   bool      // updates are being received
+	lastPoll    time.Time // last successful getUpdates
+	telegramErr error     // error of the last Telegram request, nil if it succeeded
+
+	openAIChecked time.Time // last completed OpenAI request
+	openAIErr     error     // error of the last OpenAI request, nil if it succeeded
+	probing       sync.Mutex
+}
+
+var health = &healthState{}
+
+func (h *healthState) startedReceiving() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.receiving = true
+	h.lastPoll = time.Now()
+}
+
+func (h *healthState) telegramResult(path string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.telegramErr = err
+	if err == nil && strings.HasSuffix(path, "/getUpdates") {
+		h.lastPoll = time.Now()
+	}
+}
+
+func (h *healthState) openAIResult(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.openAIChecked = time.Now()
+	h.openAIErr = err
+}
+
+// handleLiveness fails when polling stopped getting updates, a restart may help then.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	health.mutex.Lock()
+	stalled := health.receiving && cfg.UpdatesMode == updatesPolling && time.Since(health.lastPoll) > pollStallTimeout
+	lastPoll := health.lastPoll
+	health.mutex.Unlock()
+
+	if stalled {
+		http.Error(w, fmt.Sprintf("no updates received since %s", lastPoll.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadiness fails while the bot is starting or stopping, or when Telegram
+// or OpenAI can't be reached.
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	probeOpenAI(r.Context())
+
+	health.mutex.Lock()
+	var problems []string
+	if !health.receiving {
+		problems = append(problems, "not receiving updates yet")
+	}
+	if stopCtx.Err() != nil {
+		problems = append(problems, "shutting down")
+	}
+	if health.telegramErr != nil {
+		problems = append(problems, "telegram: "+health.telegramErr.Error())
+	}
+	if health.openAIErr != nil {
+		problems = append(problems, "openai: "+health.openAIErr.Error())
+	}
+	health.mutex.Unlock()
+
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// probeOpenAI lists models when the API was not called recently, so the
+// readiness reflects the current state of the API.
+func probeOpenAI(ctx context.Context) {
+	if !health.probing.TryLock() {
+		return
+	}
+	defer health.probing.Unlock()
+
+	health.mutex.Lock()
+	recent := time.Since(health.openAIChecked) < openAIProbeInterval
+	health.mutex.Unlock()
+	if recent {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := openAIClient.ListModels(ctx); err != nil {
+		log.Printf("openai probe error: %v", err)
+	}
+}
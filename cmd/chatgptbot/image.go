@@ -1,73 +1,152 @@
 package main
 
 import (
-	"context"
+	"encoding/base64"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"chatgptbot/pkg/openai"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func handleUserDraw(userID int64, msg string) (string, bool, error) {
-	ctx := context.Background()
+// imageSizes maps draw command options to image sizes.
+var imageSizes = map[string]string{
+	"256":       openai.CreateImageSize256x256,
+	"256x256":   openai.CreateImageSize256x256,
+	"512":       openai.CreateImageSize512x512,
+	"512x512":   openai.CreateImageSize512x512,
+	"1024":      openai.CreateImageSize1024x1024,
+	"1024x1024": openai.CreateImageSize1024x1024,
+}
 
-	// Sample image by link
-	reqUrl := openai.ImageRequest{
-		Prompt:         msg,
-		Size:           openai.CreateImageSize512x512,
-		ResponseFormat: openai.CreateImageResponseFormatURL,
-		N:              1,
-	}
+// isDrawPrompt reports whether the text message asks to draw, "нарисуй кот".
+func isDrawPrompt(text string) bool {
+	return strings.HasPrefix(strings.ToLower(text), "нарисуй ")
+}
 
-	respUrl, err := openAIClient.CreateImage(ctx, reqUrl)
-	if err != nil || len(respUrl.Data) < 1 || len(respUrl.Data[0].URL) == 0 {
-		log.Printf("Image creation error: %v\n", err)
-		return "", false, fmt.Errorf("Image creation error: %v\n", err)
+// parseDrawOptions takes the size and the count of images from the beginning
+// of the prompt, e.g. "1024 x2 a cat in a hat".
+func parseDrawOptions(msg string) (size string, n int, prompt string, err error) {
+	size, n, prompt, err = parseImageOptions(msg)
+	if err == nil && prompt == "" {
+		err = fmt.Errorf("Describe what to draw")
 	}
-	url := respUrl.Data[0].URL
-	log.Println(msg, " => ", url)
-
-	return url, false, nil
-
-	/*
-		// Example image as base64
-		reqBase64 := openai.ImageRequest{
-			Prompt:         msg,
-			Size:           openai.CreateImageSize512x512,
-			ResponseFormat: openai.CreateImageResponseFormatB64JSON,
-			N:              1,
-		}
+	return
+}
 
-		respBase64, err := openAIClient.CreateImage(ctx, reqBase64)
-		if err != nil {
-			fmt.Printf("Image creation error: %v\n", err)
-			return
-		}
+// parseImageOptions is like parseDrawOptions, but the prompt may be empty.
+func parseImageOptions(msg string) (size string, n int, prompt string, err error) {
+	size, n = openai.CreateImageSize512x512, 1
 
-		imgBytes, err := base64.StdEncoding.DecodeString(respBase64.Data[0].B64JSON)
-		if err != nil {
-			fmt.Printf("Base64 decode error: %v\n", err)
-			return
+	fields := strings.Fields(msg)
+	for len(fields) > 0 {
+		option := strings.ToLower(fields[0])
+		if s, ok := imageSizes[option]; ok {
+			size = s
+		} else if count, ok := parseImageCount(option); ok {
+			if count < 1 || count > cfg.ImageMaxCount {
+				return "", 0, "", fmt.Errorf("Image count must be from 1 to %d", cfg.ImageMaxCount)
+			}
+			n = count
+		} else {
+			break
 		}
+		fields = fields[1:]
+	}
 
-		r := bytes.NewReader(imgBytes)
-		imgData, err := png.Decode(r)
-		if err != nil {
-			fmt.Printf("PNG decode error: %v\n", err)
-			return
+	return size, n, strings.Join(fields, " "), nil
+}
+
+// parseImageCount parses the image count option "x2", written with a latin or cyrillic x.
+func parseImageCount(option string) (int, bool) {
+	for _, prefix := range []string{"x", "х"} {
+		if strings.HasPrefix(option, prefix) {
+			n, err := strconv.Atoi(option[len(prefix):])
+			return n, err == nil
 		}
+	}
+	return 0, false
+}
+
+// handleUserDraw generates images and sends them to the chat as photos.
+func handleUserDraw(bot *tgbotapi.BotAPI, chatID, userID int64, msg string) (string, contextTrim, error) {
+	size, n, prompt, err := parseDrawOptions(msg)
+	if err != nil {
+		return "", trimNone, err
+	}
+
+	if err := moderate(bot, chatID, userID, moderateDraw, prompt); err != nil {
+		return "", trimNone, err
+	}
 
-		file, err := os.Create("example.png")
+	if err := checkQuota(userID, chatID); err != nil {
+		return "", trimNone, err
+	}
+
+	if err := reserveImages(userID, chatID, n); err != nil {
+		return "", trimNone, err
+	}
+
+	req := openai.ImageRequest{
+		Prompt:         prompt,
+		Size:           size,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+		N:              n,
+	}
+
+	resp, err := openAIClient.CreateImage(requestCtx, req)
+	if err != nil || len(resp.Data) < 1 {
+		releaseImages(userID, chatID, n)
+		log.Printf("Image creation error: %v\n", err)
+		return "", trimNone, fmt.Errorf("Image creation error: %v\n", err)
+	}
+	releaseImages(userID, chatID, n-len(resp.Data))
+	recordImages(userID, size, len(resp.Data))
+	log.Println(prompt, " => ", len(resp.Data), "images", size)
+
+	if err := sendImages(bot, chatID, prompt, resp.Data); err != nil {
+		log.Printf("Image sending error: %v\n", err)
+		return "", trimNone, fmt.Errorf("Image sending error: %v\n", err)
+	}
+
+	return prompt, trimNone, nil
+}
+
+// sendImages sends generated images as a photo or a media group captioned with the prompt.
+func sendImages(bot *tgbotapi.BotAPI, chatID int64, caption string, data []openai.ImageResponseDataInner) error {
+	var files []tgbotapi.RequestFileData
+	for i, d := range data {
+		buf, err := base64.StdEncoding.DecodeString(d.B64JSON)
 		if err != nil {
-			fmt.Printf("File creation error: %v\n", err)
-			return
+			return fmt.Errorf("base64 decode error: %v", err)
 		}
-		defer file.Close()
+		files = append(files, tgbotapi.FileBytes{
+			Name:  fmt.Sprintf("image%d.png", i+1),
+			Bytes: buf,
+		})
+	}
 
-		if err := png.Encode(file, imgData); err != nil {
-			fmt.Printf("PNG encode error: %v\n", err)
-			return
-		}
+	// Telegram limits captions to 1024 characters
+	if len([]rune(caption)) > 1024 {
+		caption = string([]rune(caption)[:1023]) + "…"
+	}
+
+	if len(files) == 1 {
+		photo := tgbotapi.NewPhoto(chatID, files[0])
+		photo.Caption = caption
+		return send(bot, photo)
+	}
 
-		fmt.Println("The image was saved as example.png")
-	*/
+	media := make([]interface{}, 0, len(files))
+	for i, f := range files {
+		photo := tgbotapi.NewInputMediaPhoto(f)
+		if i == 0 {
+			photo.Caption = caption
+		}
+		media = append(media, photo)
+	}
+	_, err := bot.SendMediaGroup(tgbotapi.NewMediaGroup(chatID, media))
+	return err
 }
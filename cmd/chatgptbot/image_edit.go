@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // Telegram photos are JPEG
+	"image/png"
+	"os"
+	"strings"
+
+	"chatgptbot/pkg/openai"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxImageUploadSize is the limit of the image edit and variation endpoints.
+const maxImageUploadSize = 4 << 20
+
+// variationsCaptions request variations instead of an edit.
+var variationsCaptions = []string{"variations", "variation", "вариации", "вариант"}
+
+// messageImage returns the file ID of the largest photo of the message or of
+// an image sent as a document, or an empty string.
+func messageImage(m *tgbotapi.Message) string {
+	if m == nil {
+		return ""
+	}
+	if len(m.Photo) > 0 {
+		return m.Photo[len(m.Photo)-1].FileID
+	}
+	if m.Document != nil && strings.HasPrefix(m.Document.MimeType, "image/") {
+		return m.Document.FileID
+	}
+	return ""
+}
+
+// handleUserImage edits the photo using the caption as the prompt, or creates
+// variations when there is no caption. A photo sent in reply to another photo
+// is used as the mask of the replied one.
+func handleUserImage(bot *tgbotapi.BotAPI, m *tgbotapi.Message) error {
+	size, n, prompt, err := parseImageOptions(m.Caption)
+	if err != nil {
+		return err
+	}
+
+	sourceID, maskID := messageImage(m), ""
+	if replied := messageImage(m.ReplyToMessage); replied != "" {
+		sourceID, maskID = replied, sourceID
+	}
+
+	variations := prompt == ""
+	for _, c := range variationsCaptions {
+		variations = variations || strings.EqualFold(prompt, c)
+	}
+	if variations && maskID != "" {
+		return fmt.Errorf("Variations use no mask, add a caption describing the edit")
+	}
+
+	if !variations {
+		if err := moderate(bot, m.Chat.ID, m.From.ID, moderateDraw, prompt); err != nil {
+			return err
+		}
+	}
+
+	side := imageSide(size)
+	img, err := downloadImage(bot, sourceID)
+	if err != nil {
+		log.Printf("Image download error: %v\n", err)
+		return fmt.Errorf("Image download error: %v", err)
+	}
+	source := squareImage(img, side)
+
+	if err := checkQuota(m.From.ID, m.Chat.ID); err != nil {
+		return err
+	}
+
+	if err := reserveImages(m.From.ID, m.Chat.ID, n); err != nil {
+		return err
+	}
+
+	var resp openai.ImageResponse
+	if variations {
+		prompt = "variations"
+		resp, err = createVariations(source, size, n)
+	} else {
+		var mask *image.NRGBA
+		if maskID != "" {
+			maskImage, err := downloadImage(bot, maskID)
+			if err != nil {
+				releaseImages(m.From.ID, m.Chat.ID, n)
+				log.Printf("Image download error: %v\n", err)
+				return fmt.Errorf("Mask download error: %v", err)
+			}
+			mask = maskFromImage(squareImage(maskImage, side))
+		} else if isOpaque(source) {
+			// the API edits transparent areas only, without a mask the whole image is redrawn
+			mask = image.NewNRGBA(source.Bounds())
+		}
+		resp, err = createEdit(source, mask, prompt, size, n)
+	}
+	if err != nil || len(resp.Data) < 1 {
+		releaseImages(m.From.ID, m.Chat.ID, n)
+		log.Printf("Image creation error: %v\n", err)
+		return fmt.Errorf("Image creation error: %v\n", err)
+	}
+	releaseImages(m.From.ID, m.Chat.ID, n-len(resp.Data))
+	recordImages(m.From.ID, size, len(resp.Data))
+	log.Println(prompt, " => ", len(resp.Data), "images", size)
+
+	if err := sendImages(bot, m.Chat.ID, prompt, resp.Data); err != nil {
+		log.Printf("Image sending error: %v\n", err)
+		return fmt.Errorf("Image sending error: %v\n", err)
+	}
+	return nil
+}
+
+func createVariations(source *image.NRGBA, size string, n int) (openai.ImageResponse, error) {
+	f, err := writeTempPNG(source)
+	if err != nil {
+		return openai.ImageResponse{}, err
+	}
+	defer closeTemp(f)
+
+	return openAIClient.CreateVariImage(requestCtx, openai.ImageVariRequest{
+		Image:          f,
+		N:              n,
+		Size:           size,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	})
+}
+
+func createEdit(source, mask *image.NRGBA, prompt, size string, n int) (openai.ImageResponse, error) {
+	f, err := writeTempPNG(source)
+	if err != nil {
+		return openai.ImageResponse{}, err
+	}
+	defer closeTemp(f)
+
+	req := openai.ImageEditRequest{
+		Image:          f,
+		Prompt:         prompt,
+		N:              n,
+		Size:           size,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	}
+
+	if mask != nil {
+		maskFile, err := writeTempPNG(mask)
+		if err != nil {
+			return openai.ImageResponse{}, err
+		}
+		defer closeTemp(maskFile)
+		req.Mask = maskFile
+	}
+
+	return openAIClient.CreateEditImage(requestCtx, req)
+}
+
+// imageSide returns the side in pixels of an image size like "512x512".
+func imageSide(size string) int {
+	var side int
+	fmt.Sscanf(size, "%dx", &side)
+	return side
+}
+
+func downloadImage(bot *tgbotapi.BotAPI, fileID string) (image.Image, error) {
+	filename, err := downloadTelegramFile(bot, fileID, ".jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(filename)
+
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	return img, err
+}
+
+// squareImage crops the center square of the image and scales it to side
+// pixels, averaging source pixels when scaling down.
+func squareImage(img image.Image, side int) *image.NRGBA {
+	b := img.Bounds()
+	crop := b.Dx()
+	if b.Dy() < crop {
+		crop = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-crop)/2
+	y0 := b.Min.Y + (b.Dy()-crop)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		sy0 := y0 + y*crop/side
+		sy1 := y0 + (y+1)*crop/side
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < side; x++ {
+			sx0 := x0 + x*crop/side
+			sx1 := x0 + (x+1)*crop/side
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, count uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.NRGBAModel.Convert(img.At(sx, sy)).(color.NRGBA)
+					r += uint32(c.R)
+					g += uint32(c.G)
+					bl += uint32(c.B)
+					a += uint32(c.A)
+					count++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / count),
+				G: uint8(g / count),
+				B: uint8(bl / count),
+				A: uint8(a / count),
+			})
+		}
+	}
+	return dst
+}
+
+// maskFromImage keeps transparency of the mask. Masks without transparency,
+// like Telegram photos, have white areas turned transparent.
+func maskFromImage(img *image.NRGBA) *image.NRGBA {
+	if !isOpaque(img) {
+		return img
+	}
+
+	mask := image.NewNRGBA(img.Bounds())
+	draw.Draw(mask, mask.Bounds(), img, image.Point{}, draw.Src)
+	for i := 0; i < len(mask.Pix); i += 4 {
+		if mask.Pix[i] >= 240 && mask.Pix[i+1] >= 240 && mask.Pix[i+2] >= 240 {
+			mask.Pix[i+3] = 0
+		}
+	}
+	return mask
+}
+
+func isOpaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTempPNG encodes the image into a temporary PNG file opened for reading.
+// Use closeTemp to close and remove it.
+func writeTempPNG(img *image.NRGBA) (*os.File, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxImageUploadSize {
+		return nil, fmt.Errorf("image is larger than 4 MB, choose a smaller size")
+	}
+
+	f, err := os.CreateTemp("", "chatgptbot-*.png")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		closeTemp(f)
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		closeTemp(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+func closeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
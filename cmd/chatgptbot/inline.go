@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/tokenizer"
+
+	"github.com/MasterDimmy/zipologger"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// inlineQuery is the latest inline query of a user. Telegram sends a new query
+// on every keystroke, so only the query the user stopped typing at is answered.
+type inlineQuery struct {
+	query  *tgbotapi.InlineQuery
+	timer  *time.Timer
+	cancel context.CancelFunc // cancels the completion of the previous query
+}
+
+var (
+	inlineQueries      = make(map[int64]*inlineQuery)
+	inlineQueriesMutex sync.Mutex
+
+	// inlineWG counts waiting timers and running completions, shutdown waits for them
+	inlineWG sync.WaitGroup
+)
+
+// handleInlineQuery debounces inline queries of the user. It returns at once,
+// the answer is sent when the user stops typing.
+func handleInlineQuery(bot *tgbotapi.BotAPI, query *tgbotapi.InlineQuery) {
+	if strings.TrimSpace(query.Query) == "" {
+		return
+	}
+
+	userID := query.From.ID
+	delay := time.Duration(cfg.InlineDebounceMillis) * time.Millisecond
+
+	inlineQueriesMutex.Lock()
+	defer inlineQueriesMutex.Unlock()
+
+	pending, ok := inlineQueries[userID]
+	if !ok {
+		pending = &inlineQuery{}
+		inlineQueries[userID] = pending
+	}
+	pending.query = query
+	// a timer stopped before firing is still counted by inlineWG
+	if pending.timer != nil && pending.timer.Stop() {
+		pending.timer.Reset(delay)
+		return
+	}
+
+	inlineWG.Add(1)
+	pending.timer = time.AfterFunc(delay, func() {
+		defer inlineWG.Done()
+		runInlineQuery(bot, userID, pending)
+	})
+}
+
+// runInlineQuery answers the latest query of the user, cancelling the
+// completion of the previous one. The user is forgotten when no newer query
+// arrived meanwhile.
+func runInlineQuery(bot *tgbotapi.BotAPI, userID int64, pending *inlineQuery) {
+	inlineQueriesMutex.Lock()
+	query := pending.query
+	if pending.cancel != nil {
+		pending.cancel()
+	}
+	ctx, cancel := context.WithTimeout(requestCtx, time.Duration(cfg.InlineTimeoutSeconds)*time.Second)
+	pending.cancel = cancel
+	inlineQueriesMutex.Unlock()
+
+	defer func() {
+		cancel()
+
+		inlineQueriesMutex.Lock()
+		if pending.query == query && inlineQueries[userID] == pending {
+			delete(inlineQueries, userID)
+		}
+		inlineQueriesMutex.Unlock()
+	}()
+	defer zipologger.HandlePanic()
+
+	answerInlineQuery(ctx, bot, query)
+}
+
+// waitInline waits for the inline queries at most for the timeout. It reports
+// whether all of them were answered.
+func waitInline(timeout time.Duration) bool {
+	return waitTimeout(&inlineWG, timeout)
+}
+
+// answerInlineQuery runs a single-turn completion and returns it as an article.
+func answerInlineQuery(ctx context.Context, bot *tgbotapi.BotAPI, query *tgbotapi.InlineQuery) {
+	log := zipologger.NewLogger("./logs/user_"+query.From.UserName+".log", 10, 10, 10, false)
+	log.Printf("=> inline %s", query.Query)
+
+	var answer string
+	if err := authorize(query.From.ID, query.From.ID, capChat); err != nil {
+		if errors.Is(err, errBanned) {
+			return
+		}
+		answer = fmt.Sprintf("You are not allowed to use this bot. User ID: %d", query.From.ID)
+		if !errors.Is(err, errNoAccess) {
+			answer = err.Error()
+		}
+	} else if err := moderate(bot, 0, query.From.ID, moderatePrompt, query.Query); err != nil {
+		answer = err.Error()
+	} else {
+		var err error
+		answer, err = inlineCompletion(ctx, query.From.ID, query.Query)
+		if ctx.Err() != nil {
+			// a newer query replaced this one, or there was no time left
+			log.Printf("inline query %s dropped: %v", query.ID, ctx.Err())
+			return
+		}
+		if err != nil {
+			log.Print(err.Error())
+			answer = err.Error()
+		}
+	}
+	log.Printf("<= inline %s", answer)
+
+	article := tgbotapi.NewInlineQueryResultArticle(query.ID, truncate(query.Query, 64),
+		truncate(query.Query+"\n\n"+answer, telegramMessageLimit))
+	article.Description = truncate(answer, 128)
+
+	_, err := bot.Request(tgbotapi.InlineConfig{
+		InlineQueryID: query.ID,
+		Results:       []interface{}{article},
+		IsPersonal:    true,
+	})
+	if err != nil {
+		log.Printf("Error answering inline query: %v", err)
+	}
+}
+
+// inlineCompletion answers the prompt with the settings of the user, ignoring
+// the conversation history.
+func inlineCompletion(ctx context.Context, userID int64, prompt string) (string, error) {
+	if err := checkQuota(userID, userID); err != nil {
+		return "", err
+	}
+
+	user := peekUser(userID)
+	req := openai.ChatCompletionRequest{
+		Model:       user.model(userID),
+		Temperature: user.temperature(),
+		TopP:        1,
+		N:           1,
+		Messages: append(user.systemMessages(), openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: prompt,
+		}),
+	}
+	user.mutex.Unlock()
+
+	resp, err := openAIClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the prompt is likely processed already, only the answer is lost
+			chargeUsage(userID, req.Model, openai.Usage{
+				PromptTokens: tokenizer.CountMessages(encoding, req.Model, req.Messages),
+			})
+		}
+		return "", err
+	}
+	chargeUsage(userID, req.Model, resp.Usage)
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("empty answer")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
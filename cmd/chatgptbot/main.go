@@ -6,15 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
 	"time"
 
 	"chatgptbot/pkg/openai"
-	"chatgptbot/pkg/slices"
+	"chatgptbot/pkg/storage"
+	"chatgptbot/pkg/tokenizer"
+	"chatgptbot/pkg/usage"
 
 	"github.com/MasterDimmy/zipologger"
 	"github.com/caarlos0/env/v7"
@@ -28,26 +32,73 @@ var cfg struct {
 	ModelTemperature                    float32 `env:"MODEL_TEMPERATURE" envDefault:"1.0"`
 	ConversationIdleTimeoutSeconds      int     `env:"CONVERSATION_IDLE_TIMEOUT_SECONDS" envDefault:"900"`
 	NotifyUserOnConversationIdleTimeout bool    `env:"NOTIFY_USER_ON_CONVERSATION_IDLE_TIMEOUT" envDefault:"false"`
+	ConversationRestoreSeconds          int     `env:"CONVERSATION_RESTORE_SECONDS" envDefault:"3600"`
+	StreamResponse                      bool    `env:"STREAM_RESPONSE" envDefault:"true"`
+	StreamEditIntervalMillis            int     `env:"STREAM_EDIT_INTERVAL_MS" envDefault:"1500"`
+	MaxConcurrentUpdates                int     `env:"MAX_CONCURRENT_UPDATES" envDefault:"10"`
+	Storage                             string  `env:"STORAGE" envDefault:"memory"`
+	StoragePath                         string  `env:"STORAGE_PATH" envDefault:"./sessions"`
+	TokenizerRanksPath                  string  `env:"TOKENIZER_RANKS_PATH"`
+	CompletionTokenReserve              int     `env:"COMPLETION_TOKEN_RESERVE" envDefault:"1000"`
+	ContextTrimMode                     string  `env:"CONTEXT_TRIM_MODE" envDefault:"drop"`
+	Model                               string  `env:"MODEL" envDefault:"gpt-3.5-turbo"`
+	VoiceMaxDurationSeconds             int     `env:"VOICE_MAX_DURATION_SECONDS" envDefault:"300"`
+	ImagesPerDay                        int     `env:"IMAGES_PER_DAY" envDefault:"20"`
+	ImageMaxCount                       int     `env:"IMAGE_MAX_COUNT" envDefault:"4"`
+	GroupContext                        string  `env:"GROUP_CONTEXT" envDefault:"user"`
+	InlineDebounceMillis                int     `env:"INLINE_DEBOUNCE_MS" envDefault:"800"`
+	InlineTimeoutSeconds                int     `env:"INLINE_TIMEOUT_SECONDS" envDefault:"15"`
+	UsagePath                           string  `env:"USAGE_PATH" envDefault:"./usage.jsonl"`
+	UpdatesMode                         string  `env:"UPDATES_MODE" envDefault:"polling"`
+	WebhookURL                          string  `env:"WEBHOOK_URL"`
+	WebhookListen                       string  `env:"WEBHOOK_LISTEN" envDefault:":8080"`
+	WebhookSecret                       string  `env:"WEBHOOK_SECRET"`
+	WebhookTLSCert                      string  `env:"WEBHOOK_TLS_CERT"`
+	WebhookTLSKey                       string  `env:"WEBHOOK_TLS_KEY"`
+	ShutdownTimeoutSeconds              int     `env:"SHUTDOWN_TIMEOUT_SECONDS" envDefault:"30"`
+	MetricsListen                       string  `env:"METRICS_LISTEN"`
+	OpenAIMaxAttempts                   *int    `env:"OPENAI_MAX_ATTEMPTS"`
+	OpenAIRetryMaxDelaySeconds          *int    `env:"OPENAI_RETRY_MAX_DELAY_SECONDS"`
+	OpenAIKeySelection                  string  `env:"OPENAI_KEY_SELECTION" envDefault:"round-robin"`
+	AccessRequestCooldownSeconds        int     `env:"ACCESS_REQUEST_COOLDOWN_SECONDS" envDefault:"86400"`
 }
 
 type Config struct {
-	AdminTelegramID    []int64
-	AllowedTelegramID []int64
+	AdminTelegramID   []int64 `json:",omitempty"` // replaced by Access, migrated on start
+	AllowedTelegramID []int64 `json:",omitempty"` // replaced by Access, migrated on start
+	Access            AccessConfig
+	Personas          map[string]string  // system prompts by persona name
+	AllowedModels     []string           // models users may choose, empty means any chat model
+	UserModels        map[int64][]string // models allowed to particular users, overriding AllowedModels
+	Moderation        ModerationConfig
+	Limits            LimitsConfig
+	Pricing           usage.Pricing       `json:",omitempty"` // prices overriding the default ones by model
+	APIKeys           []openai.Credential `json:",omitempty"` // keys used along with OPENAI_API_KEY
 }
 
-var config Config
+var (
+	config      Config
+	configMutex sync.RWMutex
+)
 
-type User struct {
-	TelegramID     int64
-	LastActiveTime time.Time
-	HistoryMessage []openai.ChatCompletionMessage
-	//	LatestMessage  tgbotapi.Message
+// openAIClient is built in main once the configuration is loaded.
+var openAIClient *openai.Client
+
+func openAIConfig() openai.ClientConfig {
+	config := openai.DefaultConfig(os.Getenv("OPENAI_API_KEY"))
+	config.HTTPClient = &http.Client{Transport: openAITransport{next: http.DefaultTransport}}
+	openAIPool = newCredentialPool()
+	config.Credentials = openAIPool
+	// unset retry settings keep the defaults of the client
+	if cfg.OpenAIMaxAttempts != nil {
+		config.Retry.MaxAttempts = *cfg.OpenAIMaxAttempts
+	}
+	if cfg.OpenAIRetryMaxDelaySeconds != nil {
+		config.Retry.MaxBackoff = time.Duration(*cfg.OpenAIRetryMaxDelaySeconds) * time.Second
+	}
+	return config
 }
 
-var users = make(map[int64]*User)
-
-var openAIClient = openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-
 var log = zipologger.NewLogger("./logs/actions.log", 5, 5, 5, false)
 
 func main() {
@@ -59,13 +110,52 @@ func main() {
 		return
 	}
 	json.Unmarshal(buf, &config)
+	if migrateAccessConfig() {
+		if err := saveConfig(); err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return
+		}
+	}
 
 	if err := env.Parse(&cfg); err != nil {
 		fmt.Printf("%+v\n", err)
 		os.Exit(1)
 	}
+	openAIClient = openai.NewClientWithConfig(openAIConfig())
+
+	var stop context.CancelFunc
+	stopCtx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	bot, err := tgbotapi.NewBotAPI(cfg.TelegramAPIToken)
+	store, err = storage.New(cfg.Storage, cfg.StoragePath)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return
+	}
+	defer store.Close()
+
+	ledger, err = usage.Open(cfg.UsagePath)
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return
+	}
+	defer ledger.Close()
+
+	if cfg.TokenizerRanksPath != "" {
+		encoding, err = tokenizer.LoadEncodingFile(cfg.TokenizerRanksPath)
+		if err != nil {
+			log.Printf("error: %s\n", err.Error())
+			return
+		}
+	}
+
+	if err := loadUsers(); err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return
+	}
+
+	bot, err := tgbotapi.NewBotAPIWithClient(cfg.TelegramAPIToken, tgbotapi.APIEndpoint,
+		&http.Client{Transport: telegramTransport{next: http.DefaultTransport}})
 	if err != nil {
 		panic(err)
 	}
@@ -83,267 +173,346 @@ func main() {
 			Command:     "new",
 			Description: "Clear context",
 		},
+		{
+			Command:     "persona",
+			Description: "Choose persona",
+		},
+		{
+			Command:     "model",
+			Description: "Choose model",
+		},
+		{
+			Command:     "draw",
+			Description: "Draw: /draw [256|512|1024] [x2] prompt",
+		},
+		{
+			Command:     "settings",
+			Description: "Settings",
+		},
+		{
+			Command:     "summary",
+			Description: "Show summary of the earlier conversation",
+		},
+		{
+			Command:     "usage",
+			Description: "Show your usage and limits",
+		},
 		{
 			Command:     "listusers",
 			Description: "List allowed users (only admin)",
 		},
 		{
 			Command:     "adduser",
-			Description: "Add user (only admin)",
+			Description: "Assign a role: /adduser <ID> [role] (only admin)",
 		},
 		{
 			Command:     "removeuser",
 			Description: "Remove user (only admin)",
 		},
+		{
+			Command:     "ban",
+			Description: "Ban a user or group (only admin)",
+		},
+		{
+			Command:     "grant",
+			Description: "Grant a role for a while: /grant <ID> <role> 7d (only admin)",
+		},
+		{
+			Command:     "usermodels",
+			Description: "Restrict models of a user (only admin)",
+		},
+		{
+			Command:     "moderationexempt",
+			Description: "Toggle moderation of a user (only admin)",
+		},
+		{
+			Command:     "usagereport",
+			Description: "Usage by user and day: /usagereport [days] [csv] (only admin)",
+		},
+		{
+			Command:     "apikeys",
+			Description: "Usage of the OpenAI API keys (only admin)",
+		},
 	}...))
 
-	// check user context expiration every 5 seconds
+	// check user context expiration every minute
+	background.Add(1)
 	go func() {
+		defer background.Done()
 		defer zipologger.HandlePanic()
 
 		for {
-			for userID, _ := range users {
-				cleared := clearUserContextIfExpires(userID)
-				if cleared {
-					///lastMessage := user.LatestMessage
-					if cfg.NotifyUserOnConversationIdleTimeout {
-						//msg := tgbotapi.NewEditMessageText(userID, lastMessage.MessageID, lastMessage.Text+"\n\nContext cleared due to inactivity.")
-						//msg := tgbotapi.NewEditMessageText(user., lastMessage.MessageID, "Context cleared due to inactivity.")
-						//_, _ = bot.Send(msg)
-					}
-				}
+			for _, user := range listUsers() {
+				checkIdleSession(bot, user)
+			}
+			select {
+			case <-time.After(time.Minute):
+			case <-stopCtx.Done():
+				return
 			}
-			time.Sleep(time.Minute)
 		}
 	}()
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	var (
+		updates tgbotapi.UpdatesChannel
+		server  *http.Server
+	)
+	switch cfg.UpdatesMode {
+	case updatesPolling:
+		updates, err = startPolling(bot)
+	case updatesWebhook:
+		server, updates, err = startWebhook(bot)
+	default:
+		err = fmt.Errorf("unknown UPDATES_MODE: %s", cfg.UpdatesMode)
+	}
+	if err != nil {
+		log.Printf("error: %s\n", err.Error())
+		return
+	}
 
-	updates := bot.GetUpdatesChan(u)
+	dispatcher := newDispatcher(cfg.MaxConcurrentUpdates, func(update tgbotapi.Update) {
+		handleUpdate(bot, update)
+	})
+	registerDispatcherMetrics(dispatcher)
+	health.startedReceiving()
 
-	users := make(map[int64]string)
-	var mutex sync.Mutex
+	if cfg.MetricsListen != "" {
+		metricsServer := startMetricsServer()
+		defer metricsServer.Close()
+	}
 
-	for update := range updates {
-		if update.Message == nil { // ignore any non-Message updates
-			continue
+	for {
+		select {
+		case update := <-updates:
+			dispatcher.dispatch(update)
+		case <-stopCtx.Done():
+			if !shutdown(bot, server, updates, dispatcher) {
+				// closing the store and the ledger under running workers would lose their writes
+				os.Exit(1)
+			}
+			return
 		}
+	}
+}
 
-		isAdmin := func(id int64) bool {
-			return slices.Index(config.AdminTelegramID, id) != -1
-		}
+// handleUpdate processes a single update. Updates of the same chat are handled
+// one at a time, updates of different chats are handled concurrently.
+func handleUpdate(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	defer zipologger.HandlePanic()
 
-		log := zipologger.NewLogger("./logs/user_"+update.SentFrom().UserName+".log", 10, 10, 10, false)
-		log.Printf("=> %s %s", update.Message.Text, update.Message.Command())
+	updatesTotal.Inc(updateType(update))
 
-		users[update.SentFrom().ID] = update.SentFrom().UserName
+	if update.CallbackQuery != nil {
+		handleCallbackQuery(bot, update.CallbackQuery)
+		return
+	}
 
-		_, err := bot.Send(tgbotapi.NewChatAction(update.Message.Chat.ID, tgbotapi.ChatTyping))
-		if err != nil {
-			// Sending chat action returns bool value, which causes `Send` to return unmarshal error.
-			// So we need to check if it's an unmarshal error and ignore it.
-			var unmarshalError *json.UnmarshalTypeError
-			if !errors.As(err, &unmarshalError) {
-				if err != nil {
-					log.Printf("Error in sending message: %v", err) // Более подробное логирование ошибок
-					continue                                        // Продолжить цикл в случае ошибки
-				}
-			}
-		}
+	if update.InlineQuery != nil {
+		handleInlineQuery(bot, update.InlineQuery)
+		return
+	}
 
-		if len(config.AllowedTelegramID) != 0 {
-			var userAllowed bool
-			for _, allowedID := range config.AllowedTelegramID {
-				if allowedID == update.Message.Chat.ID {
-					userAllowed = true
-				}
-			}
-			if !userAllowed {
-				_, err := bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("You are not allowed to use this bot. User ID: %d", update.Message.Chat.ID)))
-				if err != nil {
-					log.Print(err.Error())
-				}
-				continue
-			}
-		}
+	if update.Message == nil { // ignore any non-Message updates
+		return
+	}
 
-		/*
-			if update.PollAnswer != nil {
-				log.Printf("poll answer got: opt id: %+v from: %s", update.PollAnswer.OptionIDs, update.SentFrom().UserName)
-			}
-		*/
-
-		/*
-			poll := tgbotapi.NewPoll(msg.ChatID, "pool question", "opt1", "opt2")
-							poll.AllowsMultipleAnswers = false
-							poll.OpenPeriod = 60
-							poll.ChatID = msg.ChatID
-
-							//msg.ChannelUsername
-
-							if _, err := bot.Send(poll); err != nil {
-								log.Printf("Error sending command response: %v", err)
-							}
-		*/
-
-		if update.Message != nil && update.Message.IsCommand() { // ignore any non-command Messages
-			// Create a new MessageConfig. We don't have text yet,
-			// so we leave it empty.
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-
-			// Extract the command from the Message.
-			switch update.Message.Command() {
-			case "start":
-				msg.Text = "Welcome to ChatGPT bot! Write something to start a conversation. Use /new to clear context and start a new conversation."
-			case "help":
-				msg.Text = "Напиши что-нибудь для начала общения. /new  очистить контекст, \"нарисуй\" для рисования"
-			case "listusers":
-				if !isAdmin(update.Message.From.ID) {
-					msg.Text = "action not allowed"
-				} else {
-					msg.Text = "Connected users:\n"
-					for id, name := range users {
-						msg.Text += fmt.Sprintf("%d - %s\n", id, name)
-					}
-					msg.Text += "Allowed users:\n"
-					for _, id := range config.AllowedTelegramID {
-						msg.Text += fmt.Sprintf("%d\n", id)
-					}
-				}
-			case "adduser":
-				if !isAdmin(update.Message.From.ID) {
-					msg.Text = "action not allowed"
-				} else {
-					func() {
-						mutex.Lock()
-						defer mutex.Unlock()
-
-						args := strings.Split(update.Message.CommandArguments(), " ")
-
-						if len(args) < 1 {
-							msg.Text = "provide user ID"
-							log.Println(msg.Text)
-							return
-						}
+	if !addressedToBot(bot, update.Message) {
+		return
+	}
 
-						newid, err := strconv.ParseInt(args[0], 10, 64)
-						if err != nil || newid == 0 {
-							msg.Text = fmt.Sprintf("incorrect newid: %d %v", newid, err)
-							log.Println(msg.Text)
-							return
-						}
+	sessionID := sessionKey(update.Message.Chat, update.Message.From)
+	// moderation warnings follow the answer
+	defer sendWarnings(bot, update.Message.Chat.ID)
 
-						config.AllowedTelegramID = append(config.AllowedTelegramID, newid)
-						config.AllowedTelegramID = slices.Compact(config.AllowedTelegramID)
+	log := zipologger.NewLogger("./logs/user_"+update.SentFrom().UserName+".log", 10, 10, 10, false)
+	log.Printf("=> %s %s", update.Message.Text, update.Message.Command())
 
-						buf, _ := json.Marshal(&config)
-						err = ioutil.WriteFile("config.cfg", buf, 0644)
-						if err != nil {
-							msg.Text = fmt.Sprintf("error: %s\n", err.Error())
-							log.Println(msg.Text)
-							return
-						}
+	usersMutex.Lock()
+	connectedUsers[update.SentFrom().ID] = update.SentFrom().UserName
+	usersMutex.Unlock()
 
-						msg.Text = fmt.Sprintf("user ID %d added successfully", newid)
-					}()
-				}
-			case "removeuser":
-				if !isAdmin(update.Message.From.ID) {
-					msg.Text = "action not allowed"
-				} else {
-					func() {
-						mutex.Lock()
-						defer mutex.Unlock()
-
-						args := strings.Split(update.Message.CommandArguments(), " ")
-
-						if len(args) < 1 {
-							msg.Text = "provide user ID"
-							log.Println(msg.Text)
-							return
-						}
+	_, err := bot.Send(tgbotapi.NewChatAction(update.Message.Chat.ID, tgbotapi.ChatTyping))
+	if err != nil {
+		// Sending chat action returns bool value, which causes `Send` to return unmarshal error.
+		// So we need to check if it's an unmarshal error and ignore it.
+		var unmarshalError *json.UnmarshalTypeError
+		if !errors.As(err, &unmarshalError) {
+			if err != nil {
+				log.Printf("Error in sending message: %v", err) // Более подробное логирование ошибок
+				return                                          // Прервать обработку в случае ошибки
+			}
+		}
+	}
 
-						newid, err := strconv.ParseInt(args[0], 10, 64)
-						if err != nil || newid == 0 {
-							msg.Text = "provide user ID"
-							//msg.Text = fmt.Sprintf("incorrect newid: %d %v", newid, err)
-							log.Println(msg.Text)
-							return
-						}
+	if err := authorize(update.Message.From.ID, update.Message.Chat.ID, messageCapability(update.Message)); err != nil {
+		denyAccess(bot, update.Message, err)
+		return
+	}
 
-						if isAdmin(newid) {
-							msg.Text = "cant remove admin"
-							return
-						}
+	/*
+		if update.PollAnswer != nil {
+			log.Printf("poll answer got: opt id: %+v from: %s", update.PollAnswer.OptionIDs, update.SentFrom().UserName)
+		}
+	*/
 
-						removed := false
-						config.AllowedTelegramID = slices.DeleteFunc(config.AllowedTelegramID, func(val int64) bool {
-							r := val == newid
-							removed = removed || r
-							return r
-						})
+	/*
+		poll := tgbotapi.NewPoll(msg.ChatID, "pool question", "opt1", "opt2")
+						poll.AllowsMultipleAnswers = false
+						poll.OpenPeriod = 60
+						poll.ChatID = msg.ChatID
 
-						if !removed {
-							msg.Text = fmt.Sprintf("user ID %d not found", newid)
-							return
-						}
+						//msg.ChannelUsername
 
-						buf, _ := json.Marshal(&config)
-						err = ioutil.WriteFile("config.cfg", buf, 0644)
-						if err != nil {
-							msg.Text = fmt.Sprintf("error: %s\n", err.Error())
-							log.Println(msg.Text)
-							return
+						if _, err := bot.Send(poll); err != nil {
+							log.Printf("Error sending command response: %v", err)
 						}
-
-						msg.Text = fmt.Sprintf("user ID %d removed successfully", newid)
-					}()
-				}
-			case "new":
-				resetUser(update.Message.From.ID)
-				msg.Text = "OK, let's start a new conversation."
-			default:
-				msg.Text = "I don't know that command"
+	*/
+
+	if update.Message != nil && update.Message.IsCommand() { // ignore any non-command Messages
+		// Create a new MessageConfig. We don't have text yet,
+		// so we leave it empty.
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
+
+		// Extract the command from the Message.
+		switch update.Message.Command() {
+		case "start":
+			msg.Text = "Welcome to ChatGPT bot! Write something to start a conversation. Use /new to clear context and start a new conversation."
+		case "help":
+			msg.Text = "Напиши что-нибудь для начала общения. /new  очистить контекст, /summary краткое содержание разговора, /persona выбрать персону, /model выбрать модель, /settings настройки, \"нарисуй\" или /draw для рисования (размер 256, 512 или 1024 и количество x2 перед описанием: \"нарисуй 1024 x2 кот\"). Пришли фото с подписью, чтобы изменить его, или без подписи, чтобы получить вариации. Маска: ответь на своё фото картинкой, где изменяемая область прозрачная или закрашена белым"
+			if persona := userPersona(sessionID); persona != "" {
+				msg.Text += "\nТекущая персона: " + persona
+			}
+		case "listusers":
+			msg.Text = handleListUsersCommand()
+		case "adduser":
+			msg.Text = handleAddUserCommand(update.Message.CommandArguments())
+		case "removeuser":
+			msg.Text = handleRemoveUserCommand(update.Message.CommandArguments())
+		case "ban":
+			msg.Text = handleBanCommand(update.Message.CommandArguments())
+		case "grant":
+			msg.Text = handleGrantCommand(update.Message.CommandArguments())
+		case "new":
+			resetUser(sessionID)
+			msg.Text = "OK, let's start a new conversation."
+		case "draw":
+			_, _, err := handleUserDraw(bot, update.Message.Chat.ID, update.Message.From.ID, update.Message.CommandArguments())
+			if err == nil {
+				return
+			}
+			msg.Text = userError(err)
+		case "settings":
+			handleSettingsCommand(sessionID, update.Message.From.ID, &msg)
+			// the reply tells whose menu it is, see settingsOwner
+			msg.ReplyToMessageID = update.Message.MessageID
+		case "model":
+			msg.Text = handleModelCommand(sessionID, update.Message.From.ID, update.Message.CommandArguments())
+		case "usermodels":
+			msg.Text = handleUserModelsCommand(update.Message.CommandArguments())
+		case "moderationexempt":
+			msg.Text = handleExemptCommand(update.Message.CommandArguments())
+		case "usage":
+			msg.Text = handleUsageCommand(update.Message.From.ID, update.Message.Chat.ID)
+		case "usagereport":
+			msg.Text = handleUsageReportCommand(bot, update.Message.Chat.ID, update.Message.CommandArguments())
+		case "apikeys":
+			msg.Text = handleAPIKeysCommand()
+		case "persona":
+			msg.Text = handlePersonaCommand(sessionID, update.Message.CommandArguments())
+		case "summary":
+			msg.Text = userSummary(sessionID)
+			if msg.Text == "" {
+				msg.Text = "Nothing has been summarized in this conversation yet."
 			}
+		default:
+			msg.Text = "I don't know that command"
+		}
 
-			log.Printf("<= %s", msg.Text)
-			if _, err := bot.Send(msg); err != nil {
+		log.Printf("<= %s", msg.Text)
+		// an empty text means the command has sent its response itself
+		if msg.Text != "" {
+			if err := send(bot, msg); err != nil {
 				log.Printf("Error sending command response: %v", err)
 			}
-		} else {
-			msg := update.Message.Text
-
-			handler := handleUserPrompt
-
-			if strings.Index(strings.ToLower(msg), "нарисуй ") == 0 {
-				msg = strings.TrimSpace(msg[len("нарисуй"):])
-				handler = handleUserDraw
+		}
+	} else {
+		if messageImage(update.Message) != "" {
+			err := handleUserImage(bot, update.Message)
+			if err != nil {
+				log.Print(err.Error())
+				if err := send(bot, tgbotapi.NewMessage(update.Message.Chat.ID, userError(err))); err != nil {
+					log.Print(err.Error())
+				}
 			}
+			return
+		}
 
-			answerText, contextTrimmed, err := handler(update.Message.From.ID, update.Message.Text)
-			log.Printf("<= %s %t %v", answerText, contextTrimmed, err)
+		msg := update.Message.Text
 
+		if messageAudio(update.Message) != nil {
+			transcript, err := handleUserVoice(bot, update.Message)
 			if err != nil {
 				log.Print(err.Error())
-
-				err = send(bot, tgbotapi.NewMessage(update.Message.Chat.ID, err.Error()))
-				if err != nil {
+				if err := send(bot, tgbotapi.NewMessage(update.Message.Chat.ID, userError(err))); err != nil {
 					log.Print(err.Error())
 				}
+				return
+			}
+			msg = transcript
+		}
+
+		var (
+			answerText     string
+			contextTrimmed contextTrim
+			answered       bool // the handler has already sent the answer
+			err            error
+		)
+
+		isDraw := isDrawPrompt(msg)
+
+		if isDraw {
+			msg = strings.TrimSpace(msg[len("нарисуй"):])
+			answered = true
+			// a transcript may ask to draw as well
+			if err = authorize(update.Message.From.ID, update.Message.Chat.ID, capDraw); err == nil {
+				answerText, contextTrimmed, err = handleUserDraw(bot, update.Message.Chat.ID, update.Message.From.ID, msg)
+			}
+		} else if err = moderate(bot, update.Message.Chat.ID, update.Message.From.ID, moderatePrompt, msg); err == nil {
+			if userStreamResponse(sessionID, update.Message.From.ID) {
+				// the answer is delivered to the chat while it is being generated
+				answered = true
+				answerText, contextTrimmed, err = handleUserPromptStream(bot, update.Message.Chat.ID, sessionID, update.Message.From.ID, msg)
 			} else {
-				err = send(bot, tgbotapi.NewMessage(update.Message.Chat.ID, answerText))
+				answerText, contextTrimmed, err = handleUserPrompt(bot, update.Message.Chat.ID, sessionID, update.Message.From.ID, msg)
+			}
+		}
+		log.Printf("<= %s %d %v", answerText, contextTrimmed, err)
+
+		if err != nil {
+			log.Print(err.Error())
+
+			err = send(bot, tgbotapi.NewMessage(update.Message.Chat.ID, userError(err)))
+			if err != nil {
+				log.Print(err.Error())
+			}
+		} else {
+			if !answered {
+				err = sendAnswer(bot, update.Message.Chat.ID, sessionID, answerText)
 				if err != nil {
 					log.Print(err.Error())
 				}
+			}
 
-				if contextTrimmed {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Context trimmed.")
-					msg.DisableNotification = true
-					err = send(bot, msg)
-					if err != nil {
-						log.Print(err.Error())
-					}
+			if contextTrimmed != trimNone {
+				text := "Context trimmed."
+				if contextTrimmed == trimSummarized {
+					text = "Earlier messages were summarized, see /summary."
+				}
+				msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+				msg.DisableNotification = true
+				err = send(bot, msg)
+				if err != nil {
+					log.Print(err.Error())
 				}
 			}
 		}
@@ -359,66 +528,93 @@ func send(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) error {
 	return err
 }
 
-func handleUserPrompt(userID int64, msg string) (string, bool, error) {
-	clearUserContextIfExpires(userID)
+// handleUserPrompt answers the prompt in the session userID, tokens are charged to fromID.
+// A blocked answer is not kept in the history.
+func handleUserPrompt(bot *tgbotapi.BotAPI, chatID, userID, fromID int64, msg string) (string, contextTrim, error) {
+	if err := checkQuota(fromID, chatID); err != nil {
+		return "", trimNone, err
+	}
 
-	if _, ok := users[userID]; !ok {
-		users[userID] = &User{
-			TelegramID:     userID,
-			LastActiveTime: time.Now(),
-			HistoryMessage: []openai.ChatCompletionMessage{},
-		}
+	var model string
+	var used openai.Usage
+	// charged after the session is unlocked, it may be the session of fromID
+	defer func() { chargeUsage(fromID, model, used) }()
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+	user.ChatID = chatID
+
+	req, contextTrimmed := prepareUserPrompt(user, fromID, msg)
+
+	resp, err := openAIClient.CreateChatCompletion(requestCtx, req)
+	if err != nil {
+		log.Print(err.Error())
+		rollbackUserPrompt(user)
+		return "", trimNone, err
 	}
+	model, used = req.Model, resp.Usage
+
+	answer := resp.Choices[0].Message
 
-	users[userID].HistoryMessage = append(users[userID].HistoryMessage, openai.ChatCompletionMessage{
+	if err := moderate(bot, chatID, fromID, moderateAnswer, answer.Content); err != nil {
+		rollbackUserPrompt(user)
+		return "", trimNone, err
+	}
+
+	commitUserAnswer(user, answer)
+
+	return answer.Content, contextTrimmed, nil
+}
+
+// prepareUserPrompt appends the prompt of fromID to the user history, trims the
+// history to fit the model context window and builds the chat request.
+func prepareUserPrompt(user *User, fromID int64, msg string) (openai.ChatCompletionRequest, contextTrim) {
+	user.HistoryMessage = append(user.HistoryMessage, openai.ChatCompletionMessage{
 		Role:    "user",
 		Content: msg,
 	})
-	users[userID].LastActiveTime = time.Now()
+
+	model := user.model(fromID)
+
+	contextTrimmed := fitContext(user, model)
 
 	req := openai.ChatCompletionRequest{
-		Model:       openai.GPT3Dot5Turbo,
-		Temperature: cfg.ModelTemperature,
+		Model:       model,
+		Temperature: user.temperature(),
 		TopP:        1,
 		N:           1,
 		// PresencePenalty:  0.2,
 		// FrequencyPenalty: 0.2,
-		Messages: users[userID].HistoryMessage,
+		Messages: append(user.contextMessages(), user.HistoryMessage...),
 	}
 
 	fmt.Println(req)
 
-	resp, err := openAIClient.CreateChatCompletion(context.Background(), req)
-	if err != nil {
-		log.Print(err.Error())
-		users[userID].HistoryMessage = users[userID].HistoryMessage[:len(users[userID].HistoryMessage)-1]
-		return "", false, err
-	}
-
-	answer := resp.Choices[0].Message
-
-	users[userID].HistoryMessage = append(users[userID].HistoryMessage, answer)
+	return req, contextTrimmed
+}
 
-	var contextTrimmed bool
-	if resp.Usage.TotalTokens > 3500 {
-		users[userID].HistoryMessage = users[userID].HistoryMessage[1:]
-		contextTrimmed = true
+// rollbackUserPrompt removes the prompt added by prepareUserPrompt after a failed request.
+func rollbackUserPrompt(user *User) {
+	if len(user.HistoryMessage) == 0 {
+		return
 	}
-
-	return answer.Content, contextTrimmed, nil
+	user.HistoryMessage = user.HistoryMessage[:len(user.HistoryMessage)-1]
 }
 
-func clearUserContextIfExpires(userID int64) bool {
-	user := users[userID]
-	if user != nil &&
-		user.LastActiveTime.Add(time.Duration(cfg.ConversationIdleTimeoutSeconds)*time.Second).Before(time.Now()) {
-		resetUser(userID)
-		return true
-	}
+// commitUserAnswer stores the answer in the user history.
+func commitUserAnswer(user *User, answer openai.ChatCompletionMessage) {
+	user.HistoryMessage = append(user.HistoryMessage, answer)
 
-	return false
+	saveUser(user)
 }
 
-func resetUser(userID int64) {
-	delete(users, userID)
+// saveConfig writes the config back to config.cfg, readable by the owner only
+// since it holds API keys. Must be called with configMutex held.
+func saveConfig() error {
+	buf, _ := json.Marshal(&config)
+	if err := ioutil.WriteFile("config.cfg", buf, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod("config.cfg", 0600)
 }
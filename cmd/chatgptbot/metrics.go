@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatgptbot/pkg/metrics"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	updatesTotal = registry.NewCounterVec("chatgptbot_updates_total",
+		"Telegram updates processed, by type.", "type")
+	openAIRequestsTotal = registry.NewCounterVec("chatgptbot_openai_requests_total",
+		"OpenAI API requests by endpoint and status code, code is \"error\" when no response was received.", "endpoint", "code")
+	openAIRequestDuration = registry.NewHistogramVec("chatgptbot_openai_request_duration_seconds",
+		"Time until OpenAI API responses, streamed responses are measured until the first event.", metrics.DefaultBuckets, "endpoint")
+	tokensTotal = registry.NewCounterVec("chatgptbot_tokens_total",
+		"Tokens consumed by model and kind, prompt or completion.", "model", "kind")
+)
+
+func init() {
+	registry.NewGaugeFunc("chatgptbot_active_sessions",
+		"Sessions active within the conversation idle timeout.", activeSessions)
+}
+
+// registerDispatcherMetrics exposes the load of the dispatcher.
+func registerDispatcherMetrics(d *dispatcher) {
+	registry.NewGaugeFunc("chatgptbot_queue_depth",
+		"Updates waiting for a handler.", func() float64 { return float64(d.pending()) })
+	registry.NewGaugeFunc("chatgptbot_handlers_running",
+		"Updates being handled.", func() float64 { return float64(len(d.limit)) })
+}
+
+// activeSessions counts sessions used within the idle timeout. Sessions busy
+// with a request are active.
+func activeSessions() float64 {
+	idle := time.Duration(cfg.ConversationIdleTimeoutSeconds) * time.Second
+	var n int
+	for _, user := range listUsers() {
+		if !user.mutex.TryLock() {
+			n++
+			continue
+		}
+		if time.Since(user.LastActiveTime) < idle {
+			n++
+		}
+		user.mutex.Unlock()
+	}
+	return float64(n)
+}
+
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	}
+	return "other"
+}
+
+// openAITransport measures OpenAI API requests and tracks the reachability of the API.
+type openAITransport struct {
+	next http.RoundTripper
+}
+
+func (t openAITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	endpoint := openAIEndpoint(req.URL.Path)
+	openAIRequestDuration.Observe(time.Since(start).Seconds(), endpoint)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	openAIRequestsTotal.Inc(endpoint, code)
+
+	// client errors are the fault of the request, not of the API
+	if err == nil && resp.StatusCode >= 500 {
+		health.openAIResult(&http.ProtocolError{ErrorString: resp.Status})
+	} else if req.Context().Err() == nil {
+		health.openAIResult(err)
+	}
+	return resp, err
+}
+
+// openAIEndpoint reduces the URL path to the API endpoint, e.g. "/chat/completions",
+// dropping the version, Azure deployments and model names.
+func openAIEndpoint(path string) string {
+	if i := strings.Index(path, "/deployments/"); i != -1 {
+		path = path[i+len("/deployments/"):]
+		if j := strings.Index(path, "/"); j != -1 {
+			path = path[j:]
+		}
+	}
+	path = strings.TrimPrefix(path, "/v1")
+	if strings.HasPrefix(path, "/models/") {
+		return "/models/{model}"
+	}
+	return path
+}
+
+// telegramTransport tracks the reachability of the Telegram Bot API.
+type telegramTransport struct {
+	next http.RoundTripper
+}
+
+func (t telegramTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 500 {
+		health.telegramResult(req.URL.Path, &http.ProtocolError{ErrorString: resp.Status})
+	} else {
+		health.telegramResult(req.URL.Path, err)
+	}
+	return resp, err
+}
+
+// startMetricsServer serves metrics and health checks on METRICS_LISTEN.
+func startMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	mux.HandleFunc("/healthz", handleLiveness)
+	mux.HandleFunc("/readyz", handleReadiness)
+
+	server := &http.Server{
+		Addr:              cfg.MetricsListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server error: %v", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/slices"
+)
+
+// modelsCacheTTL is how long the list of models available to the API key is reused.
+const modelsCacheTTL = time.Hour
+
+var modelsCache struct {
+	mutex   sync.Mutex
+	models  []string
+	fetched time.Time
+}
+
+// availableModels returns chat models available to the API key.
+func availableModels() ([]string, error) {
+	modelsCache.mutex.Lock()
+	defer modelsCache.mutex.Unlock()
+
+	if time.Since(modelsCache.fetched) < modelsCacheTTL {
+		return modelsCache.models, nil
+	}
+
+	list, err := openAIClient.ListModels(requestCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	var models []string
+	for _, m := range list.Models {
+		if isChatModel(m.ID) {
+			models = append(models, m.ID)
+		}
+	}
+	sort.Strings(models)
+
+	modelsCache.models = models
+	modelsCache.fetched = time.Now()
+	return models, nil
+}
+
+// isChatModel filters out models of other endpoints: embeddings, audio, images
+// and completion-only ones.
+func isChatModel(model string) bool {
+	return strings.HasPrefix(model, "gpt-") && openai.ChatCompletionSupportsModel(model)
+}
+
+// modelAllowed reports whether admins let the user use the model.
+func modelAllowed(userID int64, model string) bool {
+	if isAdmin(userID) {
+		return true
+	}
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	allowed, ok := config.UserModels[userID]
+	if !ok {
+		allowed = config.AllowedModels
+	}
+	return len(allowed) == 0 || slices.Contains(allowed, model)
+}
+
+// userModels returns the models the user may choose from.
+func userModels(userID int64) ([]string, error) {
+	models, err := availableModels()
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []string
+	for _, m := range models {
+		if modelAllowed(userID, m) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed, nil
+}
+
+// handleModelCommand shows or changes the model of the session userID, models
+// are allowed by the sender fromID.
+func handleModelCommand(userID, fromID int64, args string) string {
+	models, err := userModels(fromID)
+	if err != nil {
+		log.Printf("error listing models: %v", err)
+		return fmt.Sprintf("error listing models: %v", err)
+	}
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	model := strings.TrimSpace(args)
+	if model == "" {
+		var text strings.Builder
+		text.WriteString("Available models:\n")
+		for _, m := range models {
+			mark := ""
+			if m == user.model(fromID) {
+				mark = " (current)"
+			}
+			fmt.Fprintf(&text, "%s%s\n", m, mark)
+		}
+		text.WriteString("\nUse /model <name> to switch.")
+		return text.String()
+	}
+
+	if !openai.ChatCompletionSupportsModel(model) {
+		return fmt.Sprintf("%s is not a chat model.", model)
+	}
+	if !slices.Contains(models, model) {
+		return fmt.Sprintf("Model %s is not available.", model)
+	}
+
+	user.Settings.Model = model
+	saveUser(user)
+	return fmt.Sprintf("Model %s selected.", model)
+}
+
+// handleUserModelsCommand sets models allowed to a user: /usermodels <userID> [model...].
+// Without models the user falls back to the common list.
+func handleUserModelsCommand(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 1 {
+		return "usage: /usermodels <user ID> [model ...]"
+	}
+
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || userID == 0 {
+		return fmt.Sprintf("incorrect user ID: %s", fields[0])
+	}
+
+	for _, m := range fields[1:] {
+		if !openai.ChatCompletionSupportsModel(m) {
+			return fmt.Sprintf("%s is not a chat model.", m)
+		}
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if len(fields) == 1 {
+		delete(config.UserModels, userID)
+	} else {
+		if config.UserModels == nil {
+			config.UserModels = make(map[int64][]string)
+		}
+		config.UserModels[userID] = fields[1:]
+	}
+
+	if err := saveConfig(); err != nil {
+		log.Println(err.Error())
+		return fmt.Sprintf("error: %s\n", err.Error())
+	}
+
+	if len(fields) == 1 {
+		return fmt.Sprintf("user ID %d uses common models", userID)
+	}
+	return fmt.Sprintf("user ID %d may use: %s", userID, strings.Join(fields[1:], ", "))
+}
+
+// model returns the model selected in the session if it is still allowed to
+// the sender fromID, or the default one. In shared group sessions the sender
+// differs from the session.
+func (u *User) model(fromID int64) string {
+	if u.Settings.Model != "" && modelAllowed(fromID, u.Settings.Model) {
+		return u.Settings.Model
+	}
+	return cfg.Model
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/slices"
+
+	"github.com/MasterDimmy/zipologger"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Moderation modes.
+const (
+	moderationOff   = "off"
+	moderationWarn  = "warn"
+	moderationBlock = "block"
+)
+
+// Kinds of moderated texts.
+const (
+	moderatePrompt = "prompt"
+	moderateAnswer = "answer"
+	moderateDraw   = "draw"
+)
+
+// ModerationConfig configures checks of texts with the moderation endpoint.
+type ModerationConfig struct {
+	Mode             string             // off, warn or block
+	CheckAnswers     bool               // check model answers too
+	CheckDrawPrompts bool               // check image prompts too
+	Thresholds       map[string]float32 // score thresholds by category, e.g. "violence": 0.5; other categories use the API verdict
+	ExemptUsers      []int64            // users which are never checked
+	NotifyAdmins     bool               // send flagged events to admins
+}
+
+var moderationLog = zipologger.NewLogger("./logs/moderation.log", 10, 10, 30, false)
+
+var errModerationBlocked = errors.New("The message violates the usage policy and was blocked.")
+
+var (
+	// pendingWarnings are warn mode warnings by chat, sent after the answer
+	pendingWarnings      = make(map[int64][]string)
+	pendingWarningsMutex sync.Mutex
+)
+
+// moderationEnabled reports whether texts of the kind are checked for the user.
+func moderationEnabled(userID int64, kind string) bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	m := config.Moderation
+	if m.Mode == "" || m.Mode == moderationOff || slices.Contains(m.ExemptUsers, userID) {
+		return false
+	}
+
+	switch kind {
+	case moderateAnswer:
+		return m.CheckAnswers
+	case moderateDraw:
+		return m.CheckDrawPrompts
+	}
+	return true
+}
+
+// moderationBlocksAnswers reports whether answers may be withheld, then they
+// can't be streamed.
+func moderationBlocksAnswers() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return config.Moderation.Mode == moderationBlock && config.Moderation.CheckAnswers
+}
+
+// moderate checks the text and returns errModerationBlocked if it must not
+// be used. In the warn mode the text passes, and the user gets a warning
+// with sendWarnings once answered.
+// Texts pass when the moderation endpoint is not available.
+func moderate(bot *tgbotapi.BotAPI, chatID, userID int64, kind, text string) error {
+	if strings.TrimSpace(text) == "" || !moderationEnabled(userID, kind) {
+		return nil
+	}
+
+	resp, err := openAIClient.Moderations(requestCtx, openai.ModerationRequest{
+		Input: text,
+	})
+	if err != nil {
+		log.Printf("Moderation error: %v", err)
+		return nil
+	}
+	if len(resp.Results) == 0 {
+		return nil
+	}
+
+	categories := flaggedCategories(resp.Results[0])
+	if len(categories) == 0 {
+		return nil
+	}
+
+	configMutex.RLock()
+	mode, notify := config.Moderation.Mode, config.Moderation.NotifyAdmins
+	configMutex.RUnlock()
+	admins := adminIDs()
+
+	action := "warned"
+	if mode == moderationBlock {
+		action = "blocked"
+	}
+
+	usersMutex.Lock()
+	name := connectedUsers[userID]
+	usersMutex.Unlock()
+
+	event := fmt.Sprintf("%s %s of %d (%s) flagged: %s\n%s", action, kind, userID, name, strings.Join(categories, ", "), text)
+	moderationLog.Print(event)
+
+	if notify {
+		for _, admin := range admins {
+			if err := send(bot, tgbotapi.NewMessage(admin, "Moderation: "+truncate(event, telegramMessageLimit-12))); err != nil {
+				log.Print(err.Error())
+			}
+		}
+	}
+
+	if mode == moderationBlock {
+		return errModerationBlocked
+	}
+
+	// inline queries have no chat to warn in
+	if chatID != 0 {
+		pendingWarningsMutex.Lock()
+		pendingWarnings[chatID] = append(pendingWarnings[chatID],
+			fmt.Sprintf("Warning: the %s may violate the usage policy (%s).", kind, strings.Join(categories, ", ")))
+		pendingWarningsMutex.Unlock()
+	}
+	return nil
+}
+
+// sendWarnings sends the warnings moderate left for the chat.
+func sendWarnings(bot *tgbotapi.BotAPI, chatID int64) {
+	pendingWarningsMutex.Lock()
+	warnings := pendingWarnings[chatID]
+	delete(pendingWarnings, chatID)
+	pendingWarningsMutex.Unlock()
+
+	for _, warning := range warnings {
+		if err := send(bot, tgbotapi.NewMessage(chatID, warning)); err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// flaggedCategories returns categories with scores over the configured
+// thresholds, or flagged by the API when there is no threshold.
+func flaggedCategories(r openai.Result) []string {
+	scores := map[string]struct {
+		score   float32
+		flagged bool
+	}{
+		"hate":             {r.CategoryScores.Hate, r.Categories.Hate},
+		"hate/threatening": {r.CategoryScores.HateThreatening, r.Categories.HateThreatening},
+		"self-harm":        {r.CategoryScores.SelfHarm, r.Categories.SelfHarm},
+		"sexual":           {r.CategoryScores.Sexual, r.Categories.Sexual},
+		"sexual/minors":    {r.CategoryScores.SexualMinors, r.Categories.SexualMinors},
+		"violence":         {r.CategoryScores.Violence, r.Categories.Violence},
+		"violence/graphic": {r.CategoryScores.ViolenceGraphic, r.Categories.ViolenceGraphic},
+	}
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	var categories []string
+	for category, s := range scores {
+		threshold, ok := config.Moderation.Thresholds[category]
+		if ok && s.score >= threshold || !ok && s.flagged {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// handleExemptCommand toggles the moderation exemption of a user: /moderationexempt <user ID>.
+func handleExemptCommand(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 1 {
+		return "provide user ID"
+	}
+
+	var userID int64
+	if _, err := fmt.Sscan(fields[0], &userID); err != nil || userID == 0 {
+		return fmt.Sprintf("incorrect user ID: %s", fields[0])
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	exempt := &config.Moderation.ExemptUsers
+	text := fmt.Sprintf("user ID %d is exempt from moderation", userID)
+	if slices.Contains(*exempt, userID) {
+		*exempt = slices.DeleteFunc(*exempt, func(id int64) bool { return id == userID })
+		text = fmt.Sprintf("user ID %d is moderated again", userID)
+	} else {
+		*exempt = append(*exempt, userID)
+	}
+
+	if err := saveConfig(); err != nil {
+		log.Println(err.Error())
+		return fmt.Sprintf("error: %s\n", err.Error())
+	}
+	return text
+}
+
+// truncate shortens the text to at most limit runes.
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
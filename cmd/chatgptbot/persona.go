@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const personaUsage = `/persona - list personas
+/persona <name> - use persona
+/persona off - stop using persona
+/persona add <name> <prompt> - create your own persona
+/persona delete <name> - delete your persona`
+
+// handlePersonaCommand lists, selects and edits personas of the user.
+func handlePersonaCommand(userID int64, args string) string {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return user.personaList()
+	}
+
+	switch fields[0] {
+	case "off":
+		user.Settings.Persona = ""
+		saveUser(user)
+		return "Persona disabled."
+	case "add":
+		if len(fields) < 3 {
+			return personaUsage
+		}
+		name := fields[1]
+		prompt := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(args, "add")), name))
+
+		if user.Settings.CustomPersonas == nil {
+			user.Settings.CustomPersonas = make(map[string]string)
+		}
+		user.Settings.CustomPersonas[name] = prompt
+		user.Settings.Persona = name
+		saveUser(user)
+		return fmt.Sprintf("Persona %s created and selected.", name)
+	case "delete":
+		if len(fields) < 2 {
+			return personaUsage
+		}
+		name := fields[1]
+		if _, ok := user.Settings.CustomPersonas[name]; !ok {
+			return fmt.Sprintf("You have no persona %s.", name)
+		}
+		delete(user.Settings.CustomPersonas, name)
+		if user.Settings.Persona == name {
+			user.Settings.Persona = ""
+		}
+		saveUser(user)
+		return fmt.Sprintf("Persona %s deleted.", name)
+	default:
+		name := fields[0]
+		if _, ok := lookupPersona(user, name); !ok {
+			return fmt.Sprintf("Unknown persona %s.\n\n%s", name, user.personaList())
+		}
+		user.Settings.Persona = name
+		saveUser(user)
+		return fmt.Sprintf("Persona %s selected.", name)
+	}
+}
+
+// lookupPersona returns the prompt of the persona. Personas of the user take
+// precedence over the ones defined by admins.
+func lookupPersona(user *User, name string) (string, bool) {
+	if prompt, ok := user.Settings.CustomPersonas[name]; ok {
+		return prompt, true
+	}
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	prompt, ok := config.Personas[name]
+	return prompt, ok
+}
+
+// personaPrompt returns the system prompt of the selected persona, if any.
+func (u *User) personaPrompt() string {
+	if u.Settings.Persona == "" {
+		return ""
+	}
+	prompt, _ := lookupPersona(u, u.Settings.Persona)
+	return prompt
+}
+
+func (u *User) personaList() string {
+	var text strings.Builder
+
+	configMutex.RLock()
+	names := sortedKeys(config.Personas)
+	configMutex.RUnlock()
+
+	writeList := func(title string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		text.WriteString(title)
+		for _, name := range names {
+			mark := ""
+			if name == u.Settings.Persona {
+				mark = " (current)"
+			}
+			fmt.Fprintf(&text, "%s%s\n", name, mark)
+		}
+		text.WriteString("\n")
+	}
+
+	writeList("Personas:\n", names)
+	writeList("Your personas:\n", sortedKeys(u.Settings.CustomPersonas))
+
+	if u.Settings.Persona == "" {
+		text.WriteString("No persona selected.\n\n")
+	}
+	text.WriteString(personaUsage)
+
+	return text.String()
+}
+
+// userPersona returns the name of the persona selected by the user.
+func userPersona(userID int64) string {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	if user.personaPrompt() == "" {
+		return ""
+	}
+	return user.Settings.Persona
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Limits restrict how much a user may consume. Zero means no limit.
+type Limits struct {
+	RequestsPerMinute int `json:",omitempty"`
+	TokensPerDay      int `json:",omitempty"`
+	TokensPerMonth    int `json:",omitempty"`
+	ImagesPerDay      int `json:",omitempty"`
+}
+
+// LimitsConfig assigns limits to roles and to particular users, user limits
+// replace the limits of the role.
+type LimitsConfig struct {
+	Roles map[string]Limits `json:",omitempty"`
+	Users map[int64]Limits  `json:",omitempty"`
+}
+
+// userLimits returns the limits of the user in the chat, the role is resolved
+// like in authorize. Without configured limits users get IMAGES_PER_DAY and
+// admins are not limited.
+func userLimits(userID, chatID int64) Limits {
+	role := userRole(userID, chatID)
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	if limits, ok := config.Limits.Users[userID]; ok {
+		return limits
+	}
+	if limits, ok := config.Limits.Roles[role]; ok {
+		return limits
+	}
+	if role == roleAdmin {
+		return Limits{}
+	}
+	return Limits{ImagesPerDay: cfg.ImagesPerDay}
+}
+
+// rollQuota starts new daily and monthly counters when the period is over.
+// Must be called with user.mutex held.
+func (u *User) rollQuota(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Quota.Day != day {
+		u.Quota.Day = day
+		u.Quota.TokensToday = 0
+		u.Quota.ImagesToday = 0
+	}
+	if month := now.Format("2006-01"); u.Quota.Month != month {
+		u.Quota.Month = month
+		u.Quota.TokensMonth = 0
+	}
+}
+
+// checkQuota counts a request of the user in the chat to the API. It fails when
+// the user sends requests too often or has used up the tokens of the day or the month.
+func checkQuota(userID, chatID int64) error {
+	limits := userLimits(userID, chatID)
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	now := time.Now()
+	user.rollQuota(now)
+
+	if limits.TokensPerDay > 0 && user.Quota.TokensToday >= limits.TokensPerDay {
+		return fmt.Errorf("Daily token limit of %d reached. The limit resets in %s",
+			limits.TokensPerDay, untilReset(now, nextDay(now)))
+	}
+	if limits.TokensPerMonth > 0 && user.Quota.TokensMonth >= limits.TokensPerMonth {
+		return fmt.Errorf("Monthly token limit of %d reached. The limit resets in %s",
+			limits.TokensPerMonth, untilReset(now, nextMonth(now)))
+	}
+
+	if limits.RequestsPerMinute > 0 {
+		// keep the requests of the last minute only
+		recent := user.requests[:0]
+		for _, t := range user.requests {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		user.requests = recent
+
+		if len(user.requests) >= limits.RequestsPerMinute {
+			return fmt.Errorf("Too many requests, at most %d per minute. Try again in %s",
+				limits.RequestsPerMinute, user.requests[0].Add(time.Minute).Sub(now).Round(time.Second))
+		}
+		user.requests = append(user.requests, now)
+	}
+
+	return nil
+}
+
+// chargeTokens counts tokens used by the user against the token limits.
+func chargeTokens(userID int64, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	user.addTokens(tokens)
+	saveUser(user)
+}
+
+// addTokens counts tokens against the token limits. Must be called with user.mutex held.
+func (u *User) addTokens(tokens int) {
+	u.rollQuota(time.Now())
+	u.Quota.TokensToday += tokens
+	u.Quota.TokensMonth += tokens
+}
+
+// reserveImages counts n images against the daily limit of the user.
+func reserveImages(userID, chatID int64, n int) error {
+	limits := userLimits(userID, chatID)
+	if limits.ImagesPerDay <= 0 {
+		return nil
+	}
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	now := time.Now()
+	user.rollQuota(now)
+
+	if user.Quota.ImagesToday+n > limits.ImagesPerDay {
+		left := limits.ImagesPerDay - user.Quota.ImagesToday
+		if left < 0 {
+			left = 0
+		}
+		return fmt.Errorf("Daily image limit reached: %d of %d images left. The limit resets in %s",
+			left, limits.ImagesPerDay, untilReset(now, nextDay(now)))
+	}
+
+	user.Quota.ImagesToday += n
+	saveUser(user)
+	return nil
+}
+
+// releaseImages returns images which were not generated to the daily limit.
+func releaseImages(userID, chatID int64, n int) {
+	if n <= 0 || userLimits(userID, chatID).ImagesPerDay <= 0 {
+		return
+	}
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	user.Quota.ImagesToday -= n
+	if user.Quota.ImagesToday < 0 {
+		user.Quota.ImagesToday = 0
+	}
+	saveUser(user)
+}
+
+func nextDay(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+func nextMonth(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+}
+
+// untilReset formats the time left until the reset, e.g. "5h20m".
+func untilReset(now, reset time.Time) string {
+	d := reset.Sub(now).Round(time.Minute)
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatgptbot/pkg/slices"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Roles of users and groups.
+const (
+	roleAdmin  = "admin"
+	roleUser   = "user"
+	roleGuest  = "guest"
+	roleBanned = "banned"
+)
+
+// Capabilities granted by roles.
+const (
+	capChat  = "chat"
+	capDraw  = "draw"
+	capVoice = "voice"
+	capModel = "model" // choose the model
+	capAdmin = "admin" // manage users and the bot
+)
+
+// defaultRoles are the capabilities of the roles unless AccessConfig.Roles overrides them.
+var defaultRoles = map[string][]string{
+	roleAdmin:  {capChat, capDraw, capVoice, capModel, capAdmin},
+	roleUser:   {capChat, capDraw, capVoice, capModel},
+	roleGuest:  {capChat},
+	roleBanned: nil,
+}
+
+// commandCapabilities are the capabilities commands require, other commands require chat.
+var commandCapabilities = map[string]string{
+	"draw":             capDraw,
+	"model":            capModel,
+	"listusers":        capAdmin,
+	"adduser":          capAdmin,
+	"removeuser":       capAdmin,
+	"ban":              capAdmin,
+	"grant":            capAdmin,
+	"usermodels":       capAdmin,
+	"moderationexempt": capAdmin,
+	"usagereport":      capAdmin,
+	"apikeys":          capAdmin,
+}
+
+var (
+	errNoAccess = errors.New("no access")
+	errBanned   = errors.New("banned")
+)
+
+// Grant gives the user or the group a role until it expires.
+type Grant struct {
+	ID    int64
+	Role  string
+	Until time.Time
+}
+
+// AccessConfig assigns roles to users and groups. A role of the user wins over
+// the role of the group, except a banned group bans all of its members.
+type AccessConfig struct {
+	DefaultRole string              `json:",omitempty"` // role of everyone else, empty means no access
+	Roles       map[string][]string `json:",omitempty"` // capabilities by role, overriding defaultRoles
+	Assignments map[int64]string    `json:",omitempty"` // roles by user or group chat ID
+	Grants      []Grant             `json:",omitempty"` // temporary roles, overriding assignments
+}
+
+// migrateAccessConfig turns AdminTelegramID and AllowedTelegramID of older
+// configs into role assignments. An empty allowlist let everyone in, so the
+// default role becomes user. Must be called with configMutex held.
+func migrateAccessConfig() bool {
+	access := &config.Access
+	if len(config.AdminTelegramID) == 0 && len(config.AllowedTelegramID) == 0 {
+		if access.DefaultRole == "" && len(access.Assignments) == 0 && len(access.Grants) == 0 {
+			access.DefaultRole = roleUser
+			return true
+		}
+		return false
+	}
+
+	if access.Assignments == nil {
+		access.Assignments = make(map[int64]string)
+	}
+	for _, id := range config.AllowedTelegramID {
+		if _, ok := access.Assignments[id]; !ok {
+			access.Assignments[id] = roleUser
+		}
+	}
+	for _, id := range config.AdminTelegramID {
+		access.Assignments[id] = roleAdmin
+	}
+	if len(config.AllowedTelegramID) == 0 && access.DefaultRole == "" {
+		access.DefaultRole = roleUser
+	}
+
+	config.AdminTelegramID = nil
+	config.AllowedTelegramID = nil
+	return true
+}
+
+// assignedRole returns the role granted or assigned to the ID. Must be called
+// with configMutex held.
+func assignedRole(id int64, now time.Time) string {
+	for _, g := range config.Access.Grants {
+		if g.ID == id && now.Before(g.Until) {
+			return g.Role
+		}
+	}
+	return config.Access.Assignments[id]
+}
+
+// userRole returns the role of the user in the chat.
+func userRole(userID, chatID int64) string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	now := time.Now()
+	role := assignedRole(userID, now)
+	if chatID != userID && chatID != 0 {
+		if chatRole := assignedRole(chatID, now); chatRole == roleBanned || (role == "" && chatRole != "") {
+			role = chatRole
+		}
+	}
+	if role == "" {
+		role = config.Access.DefaultRole
+	}
+	return role
+}
+
+// roleCapabilities returns the capabilities of the role. Must be called with configMutex held.
+func roleCapabilities(role string) ([]string, bool) {
+	if caps, ok := config.Access.Roles[role]; ok {
+		return caps, true
+	}
+	caps, ok := defaultRoles[role]
+	return caps, ok
+}
+
+func knownRole(role string) bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	_, ok := roleCapabilities(role)
+	return ok
+}
+
+// authorize checks that the user may use the capability in the chat. It is the
+// only access check, every command and message goes through it.
+func authorize(userID, chatID int64, capability string) error {
+	role := userRole(userID, chatID)
+	switch role {
+	case "":
+		return errNoAccess
+	case roleBanned:
+		return errBanned
+	}
+
+	configMutex.RLock()
+	caps, _ := roleCapabilities(role)
+	configMutex.RUnlock()
+
+	if !slices.Contains(caps, capability) {
+		return fmt.Errorf("The %s role does not allow %s", role, capabilityName(capability))
+	}
+	return nil
+}
+
+func capabilityName(capability string) string {
+	switch capability {
+	case capChat:
+		return "chatting"
+	case capDraw:
+		return "drawing"
+	case capVoice:
+		return "voice messages"
+	case capModel:
+		return "choosing the model"
+	case capAdmin:
+		return "this action"
+	}
+	return capability
+}
+
+func isAdmin(id int64) bool {
+	return authorize(id, id, capAdmin) == nil
+}
+
+// adminIDs returns users with the admin capability.
+func adminIDs() []int64 {
+	configMutex.RLock()
+	now := time.Now()
+	ids := make(map[int64]bool)
+	for id := range config.Access.Assignments {
+		ids[id] = true
+	}
+	for _, g := range config.Access.Grants {
+		if now.Before(g.Until) {
+			ids[g.ID] = true
+		}
+	}
+	configMutex.RUnlock()
+
+	var admins []int64
+	for id := range ids {
+		// groups have negative IDs and receive no notifications
+		if id > 0 && isAdmin(id) {
+			admins = append(admins, id)
+		}
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i] < admins[j] })
+	return admins
+}
+
+// messageCapability returns the capability the message requires.
+func messageCapability(m *tgbotapi.Message) string {
+	switch {
+	case m.IsCommand():
+		if capability, ok := commandCapabilities[m.Command()]; ok {
+			return capability
+		}
+		return capChat
+	case messageImage(m) != "":
+		return capDraw
+	case messageAudio(m) != nil:
+		return capVoice
+	case isDrawPrompt(m.Text):
+		return capDraw
+	}
+	return capChat
+}
+
+// denyAccess tells the user why the message was refused. Banned users are ignored.
+func denyAccess(bot *tgbotapi.BotAPI, m *tgbotapi.Message, err error) {
+	switch {
+	case errors.Is(err, errBanned):
+		log.Printf("ignored banned user %d in %d", m.From.ID, m.Chat.ID)
+		return
+	case errors.Is(err, errNoAccess):
+		if err := send(bot, notAllowedMessage(m.Chat.ID, m.From.ID)); err != nil {
+			log.Print(err.Error())
+		}
+	default:
+		if err := send(bot, tgbotapi.NewMessage(m.Chat.ID, err.Error())); err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// setRole assigns the role to the user or group, an empty role removes the
+// assignment and the grants. Must be called with configMutex held.
+func setRole(id int64, role string) {
+	config.Access.Grants = slices.DeleteFunc(config.Access.Grants, func(g Grant) bool { return g.ID == id })
+	if role == "" {
+		delete(config.Access.Assignments, id)
+		return
+	}
+	if config.Access.Assignments == nil {
+		config.Access.Assignments = make(map[int64]string)
+	}
+	config.Access.Assignments[id] = role
+}
+
+// handleAddUserCommand assigns a role to a user or a group: "/adduser <ID> [role]".
+func handleAddUserCommand(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "Usage: /adduser <user or group ID> [role]"
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || id == 0 {
+		return fmt.Sprintf("incorrect ID: %s", fields[0])
+	}
+	role := roleUser
+	if len(fields) == 2 {
+		role = fields[1]
+	}
+	if !knownRole(role) {
+		return fmt.Sprintf("unknown role: %s", role)
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if config.Access.Assignments[id] == roleAdmin && role != roleAdmin {
+		return "cant change role of admin"
+	}
+
+	setRole(id, role)
+	if err := saveConfig(); err != nil {
+		return fmt.Sprintf("error: %s", err.Error())
+	}
+	return fmt.Sprintf("ID %d is %s now", id, role)
+}
+
+// handleRemoveUserCommand removes the role of a user or a group: "/removeuser <ID>".
+func handleRemoveUserCommand(args string) string {
+	id, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil || id == 0 {
+		return "provide user ID"
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	role, ok := config.Access.Assignments[id]
+	if role == roleAdmin {
+		return "cant remove admin"
+	}
+	if !ok && slices.IndexFunc(config.Access.Grants, func(g Grant) bool { return g.ID == id }) == -1 {
+		return fmt.Sprintf("user ID %d not found", id)
+	}
+
+	setRole(id, "")
+	if err := saveConfig(); err != nil {
+		return fmt.Sprintf("error: %s", err.Error())
+	}
+	return fmt.Sprintf("user ID %d removed successfully", id)
+}
+
+// handleBanCommand bans a user or a group: "/ban <ID>".
+func handleBanCommand(args string) string {
+	id, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil || id == 0 {
+		return "Usage: /ban <user or group ID>"
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if config.Access.Assignments[id] == roleAdmin {
+		return "cant ban admin"
+	}
+
+	setRole(id, roleBanned)
+	if err := saveConfig(); err != nil {
+		return fmt.Sprintf("error: %s", err.Error())
+	}
+	return fmt.Sprintf("ID %d is banned", id)
+}
+
+// handleGrantCommand gives a role for a while: "/grant <ID> <role> <duration>",
+// e.g. "/grant 123456 user 7d".
+func handleGrantCommand(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) != 3 {
+		return "Usage: /grant <user or group ID> <role> <duration, e.g. 12h or 7d>"
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || id == 0 {
+		return fmt.Sprintf("incorrect ID: %s", fields[0])
+	}
+	role := fields[1]
+	if !knownRole(role) {
+		return fmt.Sprintf("unknown role: %s", role)
+	}
+	d, err := parseGrantDuration(fields[2])
+	if err != nil || d <= 0 {
+		return fmt.Sprintf("incorrect duration: %s", fields[2])
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if config.Access.Assignments[id] == roleAdmin && role != roleAdmin {
+		return "cant change role of admin"
+	}
+
+	// expired grants are dropped on the way
+	now := time.Now()
+	config.Access.Grants = slices.DeleteFunc(config.Access.Grants, func(g Grant) bool { return g.ID == id || !now.Before(g.Until) })
+	until := now.Add(d).Round(time.Minute)
+	config.Access.Grants = append(config.Access.Grants, Grant{ID: id, Role: role, Until: until})
+	if err := saveConfig(); err != nil {
+		return fmt.Sprintf("error: %s", err.Error())
+	}
+	return fmt.Sprintf("ID %d is %s until %s", id, role, until.Format("2006-01-02 15:04"))
+}
+
+// parseGrantDuration parses durations of time.ParseDuration and days, "7d".
+func parseGrantDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
+
+// handleListUsersCommand lists connected users, roles and grants.
+func handleListUsersCommand() string {
+	var b strings.Builder
+
+	b.WriteString("Connected users:\n")
+	usersMutex.Lock()
+	for id, name := range connectedUsers {
+		fmt.Fprintf(&b, "%d - %s\n", id, name)
+	}
+	usersMutex.Unlock()
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	fmt.Fprintf(&b, "\nDefault role: %s\n", roleOrNone(config.Access.DefaultRole))
+
+	b.WriteString("\nRoles:\n")
+	ids := make([]int64, 0, len(config.Access.Assignments))
+	for id := range config.Access.Assignments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%d - %s\n", id, config.Access.Assignments[id])
+	}
+
+	now := time.Now()
+	var grants []string
+	for _, g := range config.Access.Grants {
+		if now.Before(g.Until) {
+			grants = append(grants, fmt.Sprintf("%d - %s until %s", g.ID, g.Role, g.Until.Format("2006-01-02 15:04")))
+		}
+	}
+	if len(grants) > 0 {
+		b.WriteString("\nGrants:\n")
+		b.WriteString(strings.Join(grants, "\n"))
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func roleOrNone(role string) string {
+	if role == "" {
+		return "none"
+	}
+	return role
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"chatgptbot/pkg/markdown"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// sendAnswer sends the Markdown answer of the session formatted, split into
+// several messages if it is too long. Parts Telegram can't parse are sent as
+// plain text. The last part is remembered for the note of notifyContextCleared.
+func sendAnswer(bot *tgbotapi.BotAPI, chatID, sessionID int64, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return send(bot, tgbotapi.NewMessage(chatID, text))
+	}
+
+	for _, part := range markdown.Split(text, telegramMessageLimit) {
+		html := markdown.ToHTML(part)
+		msg := tgbotapi.NewMessage(chatID, html)
+		msg.ParseMode = tgbotapi.ModeHTML
+		sent, err := bot.Send(msg)
+		if isMarkupError(err) {
+			log.Printf("Falling back to plain text: %v", err)
+			html, msg.ParseMode = part, ""
+			sent, err = bot.Send(tgbotapi.NewMessage(chatID, part))
+		}
+		if err != nil {
+			return err
+		}
+		rememberMessage(sessionID, chatID, sent.MessageID, html, msg.ParseMode)
+	}
+	return nil
+}
+
+// isMarkupError reports whether Telegram rejected the formatting of a message.
+func isMarkupError(err error) bool {
+	var tgErr *tgbotapi.Error
+	return errors.As(err, &tgErr) && strings.Contains(tgErr.Message, "can't parse entities")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/storage"
+)
+
+type User struct {
+	storage.Session
+	//	LatestMessage  tgbotapi.Message
+
+	// mutex guards the session and is held while a request of the user is processed
+	mutex sync.Mutex
+
+	requests []time.Time // times of the requests of the last minute, for the rate limit
+	expired  *expiredContext
+}
+
+var (
+	users          = make(map[int64]*User)
+	connectedUsers = make(map[int64]string)
+	usersMutex     sync.Mutex
+)
+
+var store storage.Store
+
+// loadUsers restores sessions saved by the previous run of the bot.
+func loadUsers() error {
+	sessions, err := store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	for _, s := range sessions {
+		users[s.TelegramID] = &User{Session: *s}
+	}
+	log.Printf("loaded %d sessions", len(sessions))
+	return nil
+}
+
+// listUsers returns a snapshot of all known users.
+func listUsers() []*User {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	list := make([]*User, 0, len(users))
+	for _, user := range users {
+		list = append(list, user)
+	}
+	return list
+}
+
+// acquireUser returns the locked user session, creating it for new users.
+// An expired conversation is cleared. The caller must unlock user.mutex.
+func acquireUser(userID int64) *User {
+	usersMutex.Lock()
+	user, ok := users[userID]
+	if !ok {
+		user = &User{
+			Session: storage.Session{
+				TelegramID:     userID,
+				HistoryMessage: []openai.ChatCompletionMessage{},
+			},
+		}
+		users[userID] = user
+	}
+	usersMutex.Unlock()
+
+	user.mutex.Lock()
+	clearUserContextIfExpires(user)
+	user.LastActiveTime = time.Now()
+	return user
+}
+
+// peekUser returns the locked user session like acquireUser, but leaves the
+// conversation and the activity time alone, for requests outside of the
+// conversation. Unknown users get a new session which is not kept. The caller
+// must unlock user.mutex.
+func peekUser(userID int64) *User {
+	usersMutex.Lock()
+	user, ok := users[userID]
+	usersMutex.Unlock()
+	if !ok {
+		user = &User{Session: storage.Session{TelegramID: userID}}
+	}
+
+	user.mutex.Lock()
+	return user
+}
+
+// saveUser writes the session through to the store. Must be called with user.mutex held.
+func saveUser(user *User) {
+	if err := store.Save(&user.Session); err != nil {
+		log.Printf("error saving session %d: %v", user.TelegramID, err)
+	}
+}
+
+// clearUserContextIfExpires clears the conversation after the idle timeout,
+// keeping the user settings. Must be called with user.mutex held.
+func clearUserContextIfExpires(user *User) bool {
+	if len(user.HistoryMessage) == 0 ||
+		!user.LastActiveTime.Add(time.Duration(cfg.ConversationIdleTimeoutSeconds)*time.Second).Before(time.Now()) {
+		return false
+	}
+
+	if cfg.ConversationRestoreSeconds > 0 {
+		user.expired = &expiredContext{
+			history: user.HistoryMessage,
+			summary: user.Summary,
+			until:   time.Now().Add(time.Duration(cfg.ConversationRestoreSeconds) * time.Second),
+		}
+	}
+
+	user.HistoryMessage = []openai.ChatCompletionMessage{}
+	user.Summary = ""
+	saveUser(user)
+	return true
+}
+
+// resetUser starts a new conversation, keeping the user settings.
+func resetUser(userID int64) {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	user.HistoryMessage = []openai.ChatCompletionMessage{}
+	user.Summary = ""
+	saveUser(user)
+}
+
+// userSummary returns the summary of the trimmed part of the conversation.
+func userSummary(userID int64) string {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	return user.Summary
+}
+
+// contextMessages returns system messages sent before the history.
+func (u *User) contextMessages() []openai.ChatCompletionMessage {
+	messages := u.systemMessages()
+	if u.Summary != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "Summary of the earlier conversation:\n" + u.Summary,
+		})
+	}
+	return messages
+}
+
+// systemMessages returns system messages made of the user settings.
+func (u *User) systemMessages() []openai.ChatCompletionMessage {
+	var messages []openai.ChatCompletionMessage
+	if prompt := u.personaPrompt(); prompt != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: prompt,
+		})
+	}
+	if u.Settings.Language != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "Always answer in " + languageName(u.Settings.Language) + ".",
+		})
+	}
+	return messages
+}
+
+func (u *User) temperature() float32 {
+	if u.Settings.Temperature != nil {
+		return *u.Settings.Temperature
+	}
+	return cfg.ModelTemperature
+}
+
+func (u *User) streamResponse(fromID int64) bool {
+	if moderationBlocksAnswers() && moderationEnabled(fromID, moderateAnswer) {
+		return false
+	}
+	if u.Settings.Stream != nil {
+		return *u.Settings.Stream
+	}
+	return cfg.StreamResponse
+}
+
+// userStreamResponse reports whether answers of the session to fromID are streamed.
+func userStreamResponse(userID, fromID int64) bool {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	return user.streamResponse(fromID)
+}
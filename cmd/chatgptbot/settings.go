@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const settingsCallback = "settings"
+
+// settingsTemperatures are the temperatures offered in the settings menu.
+var settingsTemperatures = []string{"0", "0.3", "0.7", "1", "1.3"}
+
+// settingsLanguages are answer languages offered in the settings menu, by code.
+var settingsLanguages = []struct {
+	code string
+	name string
+}{
+	{"en", "English"},
+	{"ru", "Русский"},
+	{"uk", "Українська"},
+	{"de", "Deutsch"},
+	{"es", "Español"},
+	{"fr", "Français"},
+}
+
+func init() {
+	callbackHandlers[settingsCallback] = handleSettingsCallback
+}
+
+// languageName returns the name of the language by its code.
+func languageName(code string) string {
+	for _, l := range settingsLanguages {
+		if l.code == code {
+			return l.name
+		}
+	}
+	return code
+}
+
+// settingsMenu renders the main page of the settings menu shown to fromID.
+func settingsMenu(user *User, fromID int64) (string, tgbotapi.InlineKeyboardMarkup) {
+	persona := user.Settings.Persona
+	if user.personaPrompt() == "" {
+		persona = "none"
+	}
+	language := "auto"
+	if user.Settings.Language != "" {
+		language = languageName(user.Settings.Language)
+	}
+	stream := "off"
+	if user.streamResponse(fromID) {
+		stream = "on"
+	}
+
+	text := fmt.Sprintf("Settings\n\nModel: %s\nTemperature: %g\nPersona: %s\nStreaming: %s\nLanguage: %s",
+		user.model(fromID), user.temperature(), persona, stream, language)
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Model", callbackData(settingsCallback, "model")),
+			tgbotapi.NewInlineKeyboardButtonData("Temperature", callbackData(settingsCallback, "temperature")),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Persona", callbackData(settingsCallback, "persona")),
+			tgbotapi.NewInlineKeyboardButtonData("Streaming: "+stream, callbackData(settingsCallback, "stream")),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Language", callbackData(settingsCallback, "language")),
+			tgbotapi.NewInlineKeyboardButtonData("Close", callbackData(settingsCallback, "close")),
+		),
+	)
+	return text, keyboard
+}
+
+// settingsOptions renders a page with one button per option and a back button.
+func settingsOptions(title, setting string, options [][2]string) (string, tgbotapi.InlineKeyboardMarkup) {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, o := range options {
+		data := callbackData(settingsCallback, setting, o[1])
+		if len(data) > 64 {
+			continue
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(o[0], data)))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("« Back", callbackData(settingsCallback, "menu")),
+	))
+	return title, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// handleSettingsCommand sends the settings menu.
+func handleSettingsCommand(userID, fromID int64, msg *tgbotapi.MessageConfig) {
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+
+	text, keyboard := settingsMenu(user, fromID)
+	msg.Text = text
+	msg.ReplyMarkup = keyboard
+}
+
+// settingsOwner returns the user who opened the settings menu: the sender of
+// the command the menu replies to, 0 if that is not known anymore.
+func settingsOwner(m *tgbotapi.Message) int64 {
+	if m.Chat.IsPrivate() {
+		return m.Chat.ID
+	}
+	if m.ReplyToMessage != nil && m.ReplyToMessage.From != nil {
+		return m.ReplyToMessage.From.ID
+	}
+	return 0
+}
+
+// handleSettingsCallback navigates the settings menu and applies chosen values.
+// The menu message is edited in place. In groups only the user who opened the
+// menu can use it.
+func handleSettingsCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args string) string {
+	if query.Message == nil {
+		return ""
+	}
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+
+	if settingsOwner(query.Message) != query.From.ID {
+		return "This menu belongs to another user, open yours with /settings"
+	}
+
+	if args == "close" {
+		if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID)); err != nil {
+			log.Printf("Error deleting settings: %v", err)
+		}
+		return ""
+	}
+
+	if (args == "model" || strings.HasPrefix(args, "model:")) && authorize(query.From.ID, chatID, capModel) != nil {
+		return "action not allowed"
+	}
+
+	sessionID := sessionKey(query.Message.Chat, query.From)
+
+	var models []string
+	if args == "model" {
+		var err error
+		models, err = userModels(query.From.ID)
+		if err != nil {
+			log.Printf("error listing models: %v", err)
+			return "Models are not available now"
+		}
+	}
+
+	user := acquireUser(sessionID)
+	defer user.mutex.Unlock()
+
+	setting, value, hasValue := strings.Cut(args, ":")
+	notice := ""
+	if hasValue {
+		notice = applySetting(user, query.From.ID, setting, value)
+	}
+
+	var (
+		text     string
+		keyboard tgbotapi.InlineKeyboardMarkup
+	)
+	switch {
+	case args == "model":
+		var options [][2]string
+		for _, m := range models {
+			options = append(options, [2]string{m, m})
+		}
+		text, keyboard = settingsOptions("Choose model", "model", options)
+	case args == "temperature":
+		options := [][2]string{{"Default", "default"}}
+		for _, t := range settingsTemperatures {
+			options = append(options, [2]string{t, t})
+		}
+		text, keyboard = settingsOptions("Choose temperature. Higher values make answers more random.", "temperature", options)
+	case args == "persona":
+		options := [][2]string{{"None", "off"}}
+		configMutex.RLock()
+		names := sortedKeys(config.Personas)
+		configMutex.RUnlock()
+		for _, name := range append(names, sortedKeys(user.Settings.CustomPersonas)...) {
+			options = append(options, [2]string{name, name})
+		}
+		text, keyboard = settingsOptions("Choose persona", "persona", options)
+	case args == "language":
+		options := [][2]string{{"Auto", "auto"}}
+		for _, l := range settingsLanguages {
+			options = append(options, [2]string{l.name, l.code})
+		}
+		text, keyboard = settingsOptions("Choose answer language", "language", options)
+	case args == "stream":
+		stream := !user.streamResponse(query.From.ID)
+		user.Settings.Stream = &stream
+		saveUser(user)
+		text, keyboard = settingsMenu(user, query.From.ID)
+	default:
+		text, keyboard = settingsMenu(user, query.From.ID)
+	}
+
+	_, err := bot.Request(tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, text, keyboard))
+	if err != nil {
+		log.Printf("Error editing settings: %v", err)
+	}
+	return notice
+}
+
+// applySetting validates and saves a value chosen in the menu by fromID. Must be called with user.mutex held.
+func applySetting(user *User, fromID int64, setting, value string) string {
+	switch setting {
+	case "model":
+		if !isChatModel(value) || !modelAllowed(fromID, value) {
+			return "Model is not available"
+		}
+		user.Settings.Model = value
+	case "temperature":
+		if value == "default" {
+			user.Settings.Temperature = nil
+			break
+		}
+		t, err := strconv.ParseFloat(value, 32)
+		if err != nil || t < 0 || t > 2 {
+			return "Invalid temperature"
+		}
+		temperature := float32(t)
+		user.Settings.Temperature = &temperature
+	case "persona":
+		if value == "off" {
+			user.Settings.Persona = ""
+			break
+		}
+		if _, ok := lookupPersona(user, value); !ok {
+			return "Unknown persona"
+		}
+		user.Settings.Persona = value
+	case "language":
+		if value == "auto" {
+			value = ""
+		}
+		user.Settings.Language = value
+	default:
+		return ""
+	}
+
+	saveUser(user)
+	return "Saved"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MasterDimmy/zipologger"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// abortWait is how long aborted requests get to tell their users to retry.
+const abortWait = 5 * time.Second
+
+var (
+	// stopCtx is cancelled on SIGINT or SIGTERM, no more updates are accepted then.
+	stopCtx context.Context = context.Background()
+
+	// requestCtx is the parent of all API requests. It is cancelled when
+	// in-flight requests did not finish before the shutdown deadline.
+	requestCtx, abortRequests = context.WithCancel(context.Background())
+
+	// background counts jobs which use the store besides handlers and inline
+	// queries, shutdown waits for them too
+	background sync.WaitGroup
+)
+
+// shutdown stops receiving updates, dispatches the received ones and waits for
+// the handlers, inline queries and background jobs to finish. After
+// SHUTDOWN_TIMEOUT_SECONDS the remaining API requests are aborted, and their
+// users are asked to retry. It reports whether everything stopped, only then
+// the store and the ledger may be closed.
+func shutdown(bot *tgbotapi.BotAPI, server *http.Server, updates tgbotapi.UpdatesChannel, d *dispatcher) bool {
+	log.Print("shutting down")
+	timeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+
+	if server != nil {
+		// webhook requests arriving from now on are refused, so Telegram redelivers them later
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error stopping webhook server: %v", err)
+		}
+		cancel()
+	} else {
+		bot.StopReceivingUpdates()
+	}
+
+	// updates in the channel are confirmed already: polling confirms a batch by
+	// requesting the next one, webhook requests were answered, so Telegram won't
+	// send them again
+	for drained := false; !drained; {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				drained = true
+				break
+			}
+			d.dispatch(update)
+		default:
+			drained = true
+		}
+	}
+
+	stopped := true
+	if !workersStopped(d, timeout) {
+		log.Printf("aborting requests still running after %s", timeout)
+		abortRequests()
+		if !workersStopped(d, abortWait) {
+			log.Print("handlers did not stop")
+			stopped = false
+		}
+	}
+	abortRequests()
+
+	log.Print("stopped")
+	zipologger.Wait()
+	return stopped
+}
+
+// workersStopped waits at most for the timeout for the handlers, then for the
+// inline queries they may have started and the background jobs.
+func workersStopped(d *dispatcher, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	return d.wait(timeout) &&
+		waitInline(time.Until(deadline)) &&
+		waitTimeout(&background, time.Until(deadline))
+}
+
+// userError returns the text of the error for the user.
+func userError(err error) string {
+	if requestCtx.Err() != nil {
+		return "The bot is restarting and your request was interrupted. Please send it again in a minute."
+	}
+	return err.Error()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"chatgptbot/pkg/markdown"
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/tokenizer"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramMessageLimit is the maximum length of a Telegram message in UTF-16 code units.
+const telegramMessageLimit = 4096
+
+const streamPlaceholder = "…"
+
+// handleUserPromptStream sends a placeholder message and edits it with the answer
+// while it is being generated. The answer is split into several messages if it
+// does not fit into one. Tokens are charged to fromID.
+func handleUserPromptStream(bot *tgbotapi.BotAPI, chatID, userID, fromID int64, msg string) (string, contextTrim, error) {
+	if err := checkQuota(fromID, chatID); err != nil {
+		return "", trimNone, err
+	}
+
+	var model string
+	var used openai.Usage
+	defer func() { chargeUsage(fromID, model, used) }()
+
+	user := acquireUser(userID)
+	defer user.mutex.Unlock()
+	user.ChatID = chatID
+
+	req, contextTrimmed := prepareUserPrompt(user, fromID, msg)
+
+	stream, err := openAIClient.CreateChatCompletionStream(requestCtx, req)
+	if err != nil {
+		log.Print(err.Error())
+		rollbackUserPrompt(user)
+		return "", trimNone, err
+	}
+	defer stream.Close()
+	// counted for the stats of the API key too
+	defer func() { stream.AddUsage(used) }()
+
+	// streamed responses carry no usage, so the tokens are counted
+	model = req.Model
+	used.PromptTokens = tokenizer.CountMessages(encoding, req.Model, req.Messages)
+
+	sm, err := newStreamMessage(bot, chatID, userID)
+	if err != nil {
+		rollbackUserPrompt(user)
+		return "", trimNone, err
+	}
+
+	var answer strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Print(err.Error())
+			sm.abort()
+			used.CompletionTokens = encoding.Count(answer.String())
+			rollbackUserPrompt(user)
+			return "", trimNone, err
+		}
+
+		if len(resp.Choices) == 0 {
+			continue
+		}
+
+		delta := resp.Choices[0].Delta.Content
+		answer.WriteString(delta)
+		sm.write(delta)
+	}
+
+	sm.finish()
+	used.CompletionTokens = encoding.Count(answer.String())
+
+	message := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: answer.String(),
+	}
+
+	// streamed answers are only checked in the warn mode, see moderationBlocksAnswers,
+	// but one blocked anyway is shown already and only dropped from the history
+	if err := moderate(bot, chatID, fromID, moderateAnswer, message.Content); err != nil {
+		rollbackUserPrompt(user)
+		return "", trimNone, err
+	}
+
+	commitUserAnswer(user, message)
+
+	return message.Content, contextTrimmed, nil
+}
+
+// streamMessage is a Telegram message that is progressively edited with the
+// streamed answer. Edits are throttled to respect Telegram rate limits.
+type streamMessage struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	sessionID int64
+	messageID int
+
+	text      string // text of the current message, not yet confirmed by Telegram
+	shown     string // text Telegram currently displays
+	parseMode string // parse mode of the shown text
+	nextEdit  time.Time
+	editEvery time.Duration
+}
+
+func newStreamMessage(bot *tgbotapi.BotAPI, chatID, sessionID int64) (*streamMessage, error) {
+	sm := &streamMessage{
+		bot:       bot,
+		chatID:    chatID,
+		sessionID: sessionID,
+		editEvery: time.Duration(cfg.StreamEditIntervalMillis) * time.Millisecond,
+	}
+	if err := sm.start(); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// start sends a new placeholder message which will receive further text.
+func (sm *streamMessage) start() error {
+	msg, err := sm.bot.Send(tgbotapi.NewMessage(sm.chatID, streamPlaceholder))
+	if err != nil {
+		log.Printf("Error sending placeholder: %v", err)
+		return err
+	}
+
+	sm.messageID = msg.MessageID
+	sm.text = ""
+	sm.shown = streamPlaceholder
+	sm.parseMode = ""
+	sm.nextEdit = time.Now().Add(sm.editEvery)
+	return nil
+}
+
+func (sm *streamMessage) write(delta string) {
+	sm.text += delta
+
+	for markdown.Len(sm.text) > telegramMessageLimit {
+		head, tail := markdown.Cut(sm.text, telegramMessageLimit)
+		sm.text = head
+		sm.render()
+		if err := sm.start(); err != nil {
+			return
+		}
+		sm.text = tail
+	}
+
+	if time.Now().After(sm.nextEdit) {
+		sm.flush(false)
+	}
+}
+
+// finish shows the complete text of the last message.
+func (sm *streamMessage) finish() {
+	sm.render()
+	rememberMessage(sm.sessionID, sm.chatID, sm.messageID, sm.shown, sm.parseMode)
+}
+
+// render shows the complete text of the message formatted, or as plain text
+// if Telegram can't parse the markup.
+func (sm *streamMessage) render() {
+	if strings.TrimSpace(sm.text) == "" || !sm.edit(markdown.ToHTML(sm.text), tgbotapi.ModeHTML, true) {
+		sm.flush(true)
+	}
+}
+
+// abort finalizes a partially streamed answer or removes an empty placeholder.
+func (sm *streamMessage) abort() {
+	if strings.TrimSpace(sm.text) == "" {
+		_, err := sm.bot.Request(tgbotapi.NewDeleteMessage(sm.chatID, sm.messageID))
+		if err != nil {
+			log.Printf("Error deleting placeholder: %v", err)
+		}
+		return
+	}
+
+	sm.text += streamPlaceholder
+	sm.flush(true)
+}
+
+// flush edits the message with the accumulated text. Final flushes wait for
+// Telegram rate limits instead of skipping the edit.
+func (sm *streamMessage) flush(final bool) {
+	text := sm.text
+	if strings.TrimSpace(text) == "" {
+		if !final {
+			return
+		}
+		text = streamPlaceholder
+	}
+	sm.edit(text, "", final)
+}
+
+// edit shows the text in the parse mode, it returns false if Telegram
+// rejected the markup.
+func (sm *streamMessage) edit(text, parseMode string, final bool) bool {
+	for text != sm.shown || parseMode != sm.parseMode {
+		edit := tgbotapi.NewEditMessageText(sm.chatID, sm.messageID, text)
+		edit.ParseMode = parseMode
+		_, err := sm.bot.Send(edit)
+		if err == nil {
+			sm.shown, sm.parseMode = text, parseMode
+			break
+		}
+
+		var tgErr *tgbotapi.Error
+		if errors.As(err, &tgErr) {
+			if strings.Contains(tgErr.Message, "message is not modified") {
+				sm.shown, sm.parseMode = text, parseMode
+				break
+			}
+			if tgErr.RetryAfter > 0 {
+				retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+				sm.nextEdit = time.Now().Add(retryAfter)
+				if final {
+					time.Sleep(retryAfter)
+					continue
+				}
+				return true
+			}
+		}
+
+		if isMarkupError(err) {
+			log.Printf("Falling back to plain text: %v", err)
+			return false
+		}
+		log.Printf("Error editing message: %v", err)
+		break
+	}
+
+	sm.nextEdit = time.Now().Add(sm.editEvery)
+	return true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatgptbot/pkg/markdown"
+	"chatgptbot/pkg/openai"
+	"chatgptbot/pkg/usage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// usageReportDays is the default period of /usagereport.
+const usageReportDays = 7
+
+var ledger *usage.Ledger
+
+// pricing returns the default prices overridden by Pricing of config.cfg.
+func pricing() usage.Pricing {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return usage.DefaultPricing.Merge(config.Pricing)
+}
+
+func recordUsage(r usage.Record) {
+	if err := ledger.Add(r); err != nil {
+		log.Printf("error recording usage of %d: %v", r.UserID, err)
+	}
+}
+
+// chargeUsage records the tokens the user spent with the model and counts them
+// against the token limits.
+func chargeUsage(userID int64, model string, used openai.Usage) {
+	if used.PromptTokens+used.CompletionTokens <= 0 {
+		return
+	}
+
+	recordUsage(usage.Record{
+		UserID:           userID,
+		Model:            model,
+		PromptTokens:     used.PromptTokens,
+		CompletionTokens: used.CompletionTokens,
+	})
+	chargeTokens(userID, used.PromptTokens+used.CompletionTokens)
+	tokensTotal.Add(float64(used.PromptTokens), model, "prompt")
+	tokensTotal.Add(float64(used.CompletionTokens), model, "completion")
+}
+
+// recordImages records n images of the size generated for the user.
+func recordImages(userID int64, size string, n int) {
+	recordUsage(usage.Record{
+		UserID: userID,
+		Model:  "dall-e-" + size,
+		Images: n,
+	})
+}
+
+// recordAudio records seconds of audio transcribed for the user.
+func recordAudio(userID int64, seconds int) {
+	recordUsage(usage.Record{
+		UserID:       userID,
+		Model:        openai.Whisper1,
+		AudioSeconds: seconds,
+	})
+}
+
+// handleUsageCommand shows the usage of the user today and this month,
+// together with the limits in the chat.
+func handleUsageCommand(userID, chatID int64) string {
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	today := now.Format("2006-01-02")
+	prices := pricing()
+
+	var day, month usage.Totals
+	var dayCost, monthCost float64
+	for _, row := range ledger.Rows(monthStart, func(k usage.Key) bool { return k.UserID == userID }) {
+		cost := prices.Cost(row.Model, row.Totals)
+		month.Add(row.Totals)
+		monthCost += cost
+		if row.Day == today {
+			day.Add(row.Totals)
+			dayCost += cost
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Today: %s\n", formatTotals(day, dayCost))
+	fmt.Fprintf(&b, "This month: %s\n", formatTotals(month, monthCost))
+
+	limits := userLimits(userID, chatID)
+	user := acquireUser(userID)
+	user.rollQuota(now)
+	quota := user.Quota
+	user.mutex.Unlock()
+
+	if limits.TokensPerDay > 0 {
+		fmt.Fprintf(&b, "\nTokens today: %d of %d, resets in %s", quota.TokensToday, limits.TokensPerDay, untilReset(now, nextDay(now)))
+	}
+	if limits.TokensPerMonth > 0 {
+		fmt.Fprintf(&b, "\nTokens this month: %d of %d, resets in %s", quota.TokensMonth, limits.TokensPerMonth, untilReset(now, nextMonth(now)))
+	}
+	if limits.ImagesPerDay > 0 {
+		fmt.Fprintf(&b, "\nImages today: %d of %d, resets in %s", quota.ImagesToday, limits.ImagesPerDay, untilReset(now, nextDay(now)))
+	}
+	if limits.RequestsPerMinute > 0 {
+		fmt.Fprintf(&b, "\nRequests: at most %d per minute", limits.RequestsPerMinute)
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func formatTotals(t usage.Totals, cost float64) string {
+	s := fmt.Sprintf("%d tokens (%d prompt, %d completion)", t.Tokens(), t.PromptTokens, t.CompletionTokens)
+	if t.Images > 0 {
+		s += fmt.Sprintf(", %d images", t.Images)
+	}
+	if t.AudioSeconds > 0 {
+		s += fmt.Sprintf(", %d s of audio", t.AudioSeconds)
+	}
+	return s + fmt.Sprintf(", $%.4f", cost)
+}
+
+// handleUsageReportCommand reports the usage of all users by day, for the
+// last days given in args ("/usagereport 30"). With "csv" the report is sent
+// as a CSV file broken down by model as well.
+func handleUsageReportCommand(bot *tgbotapi.BotAPI, chatID int64, args string) string {
+	days, asCSV := usageReportDays, false
+	for _, arg := range strings.Fields(args) {
+		if strings.EqualFold(arg, "csv") {
+			asCSV = true
+		} else if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			days = n
+		} else {
+			return "Usage: /usagereport [days] [csv]"
+		}
+	}
+
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, now.Location())
+	rows := ledger.Rows(since, nil)
+	if len(rows) == 0 {
+		return fmt.Sprintf("No usage during the last %d days.", days)
+	}
+	prices := pricing()
+
+	if asCSV {
+		buf, err := usageCSV(rows, prices)
+		if err != nil {
+			return err.Error()
+		}
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+			Name:  fmt.Sprintf("usage_%s_%s.csv", since.Format("2006-01-02"), now.Format("2006-01-02")),
+			Bytes: buf,
+		})
+		if err := send(bot, doc); err != nil {
+			log.Printf("Error sending usage report: %v", err)
+			return fmt.Sprintf("Error sending usage report: %v", err)
+		}
+		return ""
+	}
+
+	// the text report sums the models of a user
+	type dayUser struct {
+		day    string
+		userID int64
+	}
+	var keys []dayUser
+	totals := make(map[dayUser]*usage.Totals)
+	costs := make(map[dayUser]float64)
+	var total usage.Totals
+	var totalCost float64
+	for _, row := range rows {
+		key := dayUser{row.Day, row.UserID}
+		t, ok := totals[key]
+		if !ok {
+			t = &usage.Totals{}
+			totals[key] = t
+			keys = append(keys, key)
+		}
+		cost := prices.Cost(row.Model, row.Totals)
+		t.Add(row.Totals)
+		costs[key] += cost
+		total.Add(row.Totals)
+		totalCost += cost
+	}
+
+	var b strings.Builder
+	var day string
+	for _, key := range keys {
+		if key.day != day {
+			day = key.day
+			fmt.Fprintf(&b, "\n%s\n", day)
+		}
+		fmt.Fprintf(&b, "%s: %s\n", usageUserName(key.userID), formatTotals(*totals[key], costs[key]))
+	}
+	fmt.Fprintf(&b, "\nTotal: %s", formatTotals(total, totalCost))
+
+	report := strings.TrimSpace(b.String())
+	if markdown.Len(report) > telegramMessageLimit {
+		return "The report is too long, use /usagereport " + strconv.Itoa(days) + " csv"
+	}
+	return report
+}
+
+func usageCSV(rows []usage.Row, prices usage.Pricing) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"day", "user_id", "username", "model", "prompt_tokens", "completion_tokens", "images", "audio_seconds", "cost_usd"})
+	for _, row := range rows {
+		w.Write([]string{
+			row.Day,
+			strconv.FormatInt(row.UserID, 10),
+			usageUserName(row.UserID),
+			row.Model,
+			strconv.Itoa(row.PromptTokens),
+			strconv.Itoa(row.CompletionTokens),
+			strconv.Itoa(row.Images),
+			strconv.Itoa(row.AudioSeconds),
+			strconv.FormatFloat(prices.Cost(row.Model, row.Totals), 'f', 6, 64),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// usageUserName returns the username of a user seen since the start, or the ID.
+func usageUserName(userID int64) string {
+	usersMutex.Lock()
+	name := connectedUsers[userID]
+	usersMutex.Unlock()
+
+	if name == "" {
+		return strconv.FormatInt(userID, 10)
+	}
+	return "@" + name
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"chatgptbot/pkg/openai"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// audioFile describes a voice, audio or video note attachment.
+type audioFile struct {
+	fileID   string
+	duration int
+	ext      string // used when Telegram reports no file extension
+}
+
+// messageAudio returns the audio attachment of the message, or nil.
+func messageAudio(m *tgbotapi.Message) *audioFile {
+	switch {
+	case m.Voice != nil:
+		return &audioFile{fileID: m.Voice.FileID, duration: m.Voice.Duration, ext: ".ogg"}
+	case m.Audio != nil:
+		return &audioFile{fileID: m.Audio.FileID, duration: m.Audio.Duration, ext: ".mp3"}
+	case m.VideoNote != nil:
+		return &audioFile{fileID: m.VideoNote.FileID, duration: m.VideoNote.Duration, ext: ".mp4"}
+	}
+	return nil
+}
+
+// handleUserVoice transcribes the audio of the message and echoes the transcript.
+func handleUserVoice(bot *tgbotapi.BotAPI, m *tgbotapi.Message) (string, error) {
+	audio := messageAudio(m)
+
+	if audio.duration > cfg.VoiceMaxDurationSeconds {
+		return "", fmt.Errorf("Audio is too long: %d seconds, at most %d seconds are supported", audio.duration, cfg.VoiceMaxDurationSeconds)
+	}
+
+	if err := checkQuota(m.From.ID, m.Chat.ID); err != nil {
+		return "", err
+	}
+
+	filename, err := downloadTelegramFile(bot, audio.fileID, audio.ext)
+	if err != nil {
+		log.Printf("Audio download error: %v\n", err)
+		return "", fmt.Errorf("Audio download error: %v", err)
+	}
+	defer os.Remove(filename)
+
+	resp, err := openAIClient.CreateTranscription(requestCtx, openai.AudioRequest{
+		Model:    openai.Whisper1,
+		FilePath: filename,
+	})
+	if err != nil {
+		log.Printf("Transcription error: %v\n", err)
+		return "", fmt.Errorf("Transcription error: %v", err)
+	}
+	recordAudio(m.From.ID, audio.duration)
+
+	transcript := strings.TrimSpace(resp.Text)
+	if transcript == "" {
+		return "", fmt.Errorf("No speech recognized")
+	}
+
+	echo := tgbotapi.NewMessage(m.Chat.ID, "🎤 "+transcript)
+	echo.ReplyToMessageID = m.MessageID
+	if err := send(bot, echo); err != nil {
+		log.Print(err.Error())
+	}
+
+	return transcript, nil
+}
+
+// downloadTelegramFile saves the file into a temporary file and returns its
+// name. Whisper detects the format by the extension, so it is kept.
+// The caller must remove the file.
+func downloadTelegramFile(bot *tgbotapi.BotAPI, fileID, defaultExt string) (string, error) {
+	url, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(url)
+	if ext == "" {
+		ext = defaultExt
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "chatgptbot-*"+ext)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
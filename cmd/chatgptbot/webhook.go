@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Ways to receive updates from Telegram.
+const (
+	updatesPolling = "polling"
+	updatesWebhook = "webhook"
+)
+
+// secretTokenHeader carries the secret token given to setWebhook in every webhook request.
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// maxUpdateSize limits the body of a webhook request.
+const maxUpdateSize = 1 << 20
+
+// startWebhook registers the webhook with Telegram and starts the HTTP server
+// receiving updates. TLS is used when a certificate is configured, otherwise
+// the server is expected to run behind a reverse proxy terminating HTTPS.
+func startWebhook(bot *tgbotapi.BotAPI) (*http.Server, tgbotapi.UpdatesChannel, error) {
+	if cfg.WebhookURL == "" {
+		return nil, nil, fmt.Errorf("WEBHOOK_URL is required in the webhook mode")
+	}
+	link, err := url.Parse(cfg.WebhookURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("incorrect WEBHOOK_URL: %w", err)
+	}
+	path := link.Path
+	if path == "" {
+		path = "/"
+	}
+
+	secret := cfg.WebhookSecret
+	if secret == "" {
+		// a new secret on every start still keeps out anyone but Telegram
+		if secret, err = randomSecret(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(secret)) != 1 {
+			log.Printf("webhook request from %s with a wrong secret token", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUpdateSize)
+		update, err := bot.HandleUpdate(r)
+		if err != nil {
+			log.Printf("error decoding webhook update: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case updates <- *update:
+		case <-stopCtx.Done():
+			// not handled, Telegram retries later
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	})
+
+	listener, err := net.Listen("tcp", cfg.WebhookListen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		var err error
+		if cfg.WebhookTLSCert != "" {
+			err = server.ServeTLS(listener, cfg.WebhookTLSCert, cfg.WebhookTLSKey)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("webhook server error: %v", err)
+		}
+	}()
+
+	params := tgbotapi.Params{
+		"url":             cfg.WebhookURL,
+		"secret_token":    secret,
+		"max_connections": webhookMaxConnections(cfg.MaxConcurrentUpdates),
+	}
+	if _, err := bot.MakeRequest("setWebhook", params); err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("setting webhook: %w", err)
+	}
+
+	log.Printf("webhook %s, listening on %s", cfg.WebhookURL, listener.Addr())
+	return server, updates, nil
+}
+
+// startPolling removes a webhook left by the webhook mode, Telegram refuses
+// getUpdates while it is set, and starts long polling.
+func startPolling(bot *tgbotapi.BotAPI) (tgbotapi.UpdatesChannel, error) {
+	if _, err := bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("deleting webhook: %w", err)
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	return bot.GetUpdatesChan(u), nil
+}
+
+// randomSecret generates a secret token, Telegram allows 1-256 characters of A-Z, a-z, 0-9, _ and -.
+func randomSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// webhookMaxConnections fits n into 1-100, the range Telegram accepts for max_connections.
+func webhookMaxConnections(n int) string {
+	if n < 1 {
+		n = 1
+	} else if n > 100 {
+		n = 100
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,306 @@
+// Package markdown renders Markdown written by language models as the HTML
+// subset supported by Telegram, and splits long texts into messages.
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	headingRe     = regexp.MustCompile(`^ {0,3}#{1,6}\s+(.*?)\s*#*\s*$`)
+	bulletRe      = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	orderedRe     = regexp.MustCompile(`^(\s*)(\d{1,9}[.)])\s+(.*)$`)
+	ruleRe        = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	tableDelimRe  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(?:\|\s*:?-+:?\s*)*\|?\s*$`)
+	htmlEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+	languageClean = regexp.MustCompile(`[^\w+#.-]`)
+)
+
+// Escape escapes text for Telegram HTML.
+func Escape(text string) string {
+	return htmlEscaper.Replace(text)
+}
+
+// ToHTML renders Markdown as Telegram HTML. Code blocks become pre elements,
+// headings bold text, lists bullets, and tables aligned preformatted text.
+// Anything it does not recognize is kept as escaped text.
+func ToHTML(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var out []string
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if marker, info, ok := openingFence(line); ok {
+			var code []string
+			for i++; i < len(lines) && !closesFence(lines[i], marker); i++ {
+				code = append(code, lines[i])
+			}
+			out = append(out, codeBlock(info, strings.Join(code, "\n")))
+			continue
+		}
+
+		if isTableRow(line) && i+1 < len(lines) && tableDelimRe.MatchString(lines[i+1]) {
+			rows := [][]string{tableCells(line)}
+			for i += 2; i < len(lines) && isTableRow(lines[i]); i++ {
+				rows = append(rows, tableCells(lines[i]))
+			}
+			i--
+			out = append(out, table(rows))
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(line), ">") {
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				l := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, inline(strings.TrimPrefix(l, " ")))
+			}
+			i--
+			out = append(out, "<blockquote>"+strings.Join(quote, "\n")+"</blockquote>")
+			continue
+		}
+
+		switch {
+		case headingRe.MatchString(line):
+			out = append(out, "<b>"+inline(headingRe.FindStringSubmatch(line)[1])+"</b>")
+		case ruleRe.MatchString(line):
+			out = append(out, "——————")
+		case bulletRe.MatchString(line):
+			m := bulletRe.FindStringSubmatch(line)
+			out = append(out, m[1]+"• "+inline(m[2]))
+		case orderedRe.MatchString(line):
+			m := orderedRe.FindStringSubmatch(line)
+			out = append(out, m[1]+m[2]+" "+inline(m[3]))
+		default:
+			out = append(out, inline(line))
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// openingFence reports whether the line opens a code block, returning the fence
+// marker and the info string.
+func openingFence(line string) (marker, info string, ok bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return "", "", false
+	}
+	for _, c := range []byte{'`', '~'} {
+		n := 0
+		for n < len(trimmed) && trimmed[n] == c {
+			n++
+		}
+		if n >= 3 {
+			info = strings.TrimSpace(trimmed[n:])
+			if c == '`' && strings.Contains(info, "`") {
+				return "", "", false
+			}
+			return trimmed[:n], info, true
+		}
+	}
+	return "", "", false
+}
+
+func closesFence(line, marker string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, marker) && strings.Trim(trimmed, marker[:1]) == ""
+}
+
+func codeBlock(info, code string) string {
+	language := ""
+	if fields := strings.Fields(info); len(fields) > 0 {
+		language = languageClean.ReplaceAllString(fields[0], "")
+	}
+	if language == "" {
+		return "<pre>" + Escape(code) + "</pre>"
+	}
+	return `<pre><code class="language-` + language + `">` + Escape(code) + "</code></pre>"
+}
+
+func isTableRow(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "|") && strings.Count(trimmed, "|") >= 2
+}
+
+func tableCells(line string) []string {
+	trimmed := strings.TrimSpace(line)
+	trimmed = strings.TrimPrefix(trimmed, "|")
+	trimmed = strings.TrimSuffix(trimmed, "|")
+	cells := strings.Split(trimmed, "|")
+	for i, c := range cells {
+		cells[i] = stripInline(strings.TrimSpace(c))
+	}
+	return cells
+}
+
+// table renders rows as preformatted text with aligned columns, Telegram has no tables.
+func table(rows [][]string) string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var b strings.Builder
+	for r, row := range rows {
+		if r > 0 {
+			b.WriteString("\n")
+		}
+		for i, cell := range row {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			b.WriteString(cell)
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+			}
+		}
+		if r == 0 {
+			b.WriteString("\n")
+			for i, w := range widths {
+				if i > 0 {
+					b.WriteString("-+-")
+				}
+				b.WriteString(strings.Repeat("-", w))
+			}
+		}
+	}
+	return "<pre>" + Escape(b.String()) + "</pre>"
+}
+
+// stripInline removes emphasis markers, keeping the text, for contexts without formatting.
+func stripInline(s string) string {
+	for _, marker := range []string{"**", "__", "~~", "`"} {
+		s = strings.ReplaceAll(s, marker, "")
+	}
+	return s
+}
+
+// inline renders emphasis, code spans and links of a line.
+func inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if html, n := inlineAt(s, i); n > 0 {
+			b.WriteString(html)
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(Escape(string(r)))
+		i += size
+	}
+	return b.String()
+}
+
+// inlineAt renders the element starting at i, returning its length in s, or 0
+// if there is none.
+func inlineAt(s string, i int) (string, int) {
+	rest := s[i:]
+	switch rest[0] {
+	case '`':
+		ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+		fence := rest[:ticks]
+		if end := strings.Index(rest[ticks:], fence); end > 0 {
+			code := strings.TrimSpace(rest[ticks : ticks+end])
+			return "<code>" + Escape(code) + "</code>", 2*ticks + end
+		}
+	case '[':
+		if html, n := link(rest); n > 0 {
+			return html, n
+		}
+	case '*', '_', '~':
+		for _, e := range []struct{ marker, open, close string }{
+			{"***", "<b><i>", "</i></b>"},
+			{"**", "<b>", "</b>"},
+			{"__", "<b>", "</b>"},
+			{"~~", "<s>", "</s>"},
+			{"*", "<i>", "</i>"},
+			{"_", "<i>", "</i>"},
+		} {
+			if html, n := emphasis(s, i, e.marker); n > 0 {
+				return e.open + html + e.close, n
+			}
+		}
+	}
+	return "", 0
+}
+
+// emphasis renders text between the marker at i and its closing counterpart.
+// Underscores inside words, like snake_case, are not emphasis.
+func emphasis(s string, i int, marker string) (string, int) {
+	rest := s[i:]
+	if !strings.HasPrefix(rest, marker) || len(rest) <= len(marker) {
+		return "", 0
+	}
+	intraword := marker[0] == '_'
+	if intraword && i > 0 && isWordRune(lastRune(s[:i])) {
+		return "", 0
+	}
+	first, _ := utf8.DecodeRuneInString(rest[len(marker):])
+	if unicode.IsSpace(first) {
+		return "", 0
+	}
+
+	for from := len(marker); from < len(rest); {
+		end := strings.Index(rest[from:], marker)
+		if end < 0 {
+			return "", 0
+		}
+		end += from
+		closing := end + len(marker)
+		inner := rest[len(marker):end]
+		// the closer must follow text and be no part of a longer marker
+		ok := inner != "" && !unicode.IsSpace(lastRune(inner)) &&
+			rest[end-1] != marker[0] && !(closing < len(rest) && rest[closing] == marker[0]) &&
+			!(intraword && closing < len(rest) && isWordRune(firstRune(rest[closing:])))
+		if ok {
+			return inline(inner), closing
+		}
+		from = end + 1
+	}
+	return "", 0
+}
+
+// link renders [text](url).
+func link(s string) (string, int) {
+	close := strings.Index(s, "](")
+	if close < 0 || strings.Contains(s[1:close], "\n") {
+		return "", 0
+	}
+	end := strings.Index(s[close+2:], ")")
+	if end < 0 {
+		return "", 0
+	}
+	url := strings.TrimSpace(s[close+2 : close+2+end])
+	if url == "" || strings.ContainsAny(url, " \t") {
+		return "", 0
+	}
+	text := inline(s[1:close])
+	return `<a href="` + attrEscaper.Replace(url) + `">` + text + "</a>", close + 3 + end
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
@@ -0,0 +1,47 @@
+package markdown
+
+import "testing"
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"escaping", "a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"tags as text", "<b>not bold</b>", "&lt;b&gt;not bold&lt;/b&gt;"},
+		{"bold", "**bold** and __bold__", "<b>bold</b> and <b>bold</b>"},
+		{"italic", "*it* and _it_", "<i>it</i> and <i>it</i>"},
+		{"strike", "~~gone~~", "<s>gone</s>"},
+		{"bold italic", "***both***", "<b><i>both</i></b>"},
+		{"nested", "**bold *it* bold**", "<b>bold <i>it</i> bold</b>"},
+		{"nested bold in italic", "*a **b** c*", "<i>a <b>b</b> c</i>"},
+		{"adjacent", "**x**y**z**", "<b>x</b>y<b>z</b>"},
+		{"unclosed bold", "**not closed", "**not closed"},
+		{"unclosed italic", "2 * 3 * 4", "2 * 3 * 4"},
+		{"lone markers", "1 ** 2 __ 3", "1 ** 2 __ 3"},
+		{"intraword underscore", "snake_case_name", "snake_case_name"},
+		{"code span", "`a<b` and **`x`**", "<code>a&lt;b</code> and <b><code>x</code></b>"},
+		{"code span keeps markers", "`**x**`", "<code>**x**</code>"},
+		{"double backticks", "``a`b``", "<code>a`b</code>"},
+		{"unclosed code span", "`open", "`open"},
+		{"link", "[docs](https://x.com/?a=1&b=\"2\")", `<a href="https://x.com/?a=1&amp;b=&quot;2&quot;">docs</a>`},
+		{"link with emphasis", "[**go**](https://go.dev)", `<a href="https://go.dev"><b>go</b></a>`},
+		{"not a link", "[a] (b)", "[a] (b)"},
+		{"heading", "## Title #", "<b>Title</b>"},
+		{"bullets", "- one\n  * two", "• one\n  • two"},
+		{"ordered", "1. first\n2) second", "1. first\n2) second"},
+		{"quote", "> a *b*\n> c", "<blockquote>a <i>b</i>\nc</blockquote>"},
+		{"rule", "---", "——————"},
+		{"code block", "```go\nif a < b {}\n```", `<pre><code class="language-go">if a &lt; b {}</code></pre>`},
+		{"code block without language", "~~~\n**x**\n~~~", "<pre>**x**</pre>"},
+		{"unclosed code block", "```\ncode", "<pre>code</pre>"},
+		{"table", "| a | bb |\n|---|:-:|\n| **ccc** | d |", "<pre>a   | bb\n----+---\nccc | d</pre>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToHTML(tt.in); got != tt.want {
+				t.Errorf("ToHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package markdown
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Len returns the length of the text in UTF-16 code units, the way Telegram
+// counts message lengths.
+func Len(text string) int {
+	n := 0
+	for _, r := range text {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
+
+// Split splits text into parts of at most limit UTF-16 code units, see Cut.
+func Split(text string, limit int) []string {
+	var parts []string
+	for text != "" {
+		var head string
+		head, text = Cut(text, limit)
+		parts = append(parts, head)
+	}
+	return parts
+}
+
+// Cut splits a head of at most limit UTF-16 code units off the text,
+// preferring paragraph, line and word boundaries. A code block open at the cut
+// is closed at the end of the head and opened again at the start of the tail,
+// so both render on their own, unless a long fence would make the head too
+// long or the tail no shorter than the text.
+func Cut(text string, limit int) (string, string) {
+	n := Len(text)
+	if n <= limit {
+		return text, ""
+	}
+
+	// room for closing the code block
+	const reserve = 4
+	head, tail := cutAt(text, limit-reserve)
+
+	if marker, opening := openBlock(head); marker != "" {
+		closed := strings.TrimRight(head, "\n") + "\n" + marker
+		if reopened := opening + "\n" + tail; Len(closed) <= limit && Len(reopened) < n {
+			return closed, reopened
+		}
+	}
+	return head, tail
+}
+
+// cutAt cuts the text at limit, moving the cut back to the last paragraph,
+// line or word boundary in the second half of the head.
+func cutAt(text string, limit int) (string, string) {
+	cut, units := len(text), 0
+	for i, r := range text {
+		n := len(utf16.Encode([]rune{r}))
+		if units+n > limit {
+			cut = i
+			break
+		}
+		units += n
+	}
+
+	// at least one character, even if it does not fit
+	if cut == 0 {
+		_, cut = utf8.DecodeRuneInString(text)
+	}
+
+	head := text[:cut]
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(head, sep); i > len(head)/2 {
+			return text[:i+len(sep)], text[i+len(sep):]
+		}
+	}
+	return head, text[cut:]
+}
+
+// openBlock returns the marker and the opening line of a code block left open
+// at the end of the text, or empty strings.
+func openBlock(text string) (marker, opening string) {
+	for _, line := range strings.Split(text, "\n") {
+		if marker != "" {
+			if closesFence(line, marker) {
+				marker, opening = "", ""
+			}
+			continue
+		}
+		if m, _, ok := openingFence(line); ok {
+			marker, opening = m, strings.TrimSpace(line)
+		}
+	}
+	return marker, opening
+}
@@ -0,0 +1,145 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLen(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"привет", 6},
+		{"😀", 2},
+	}
+	for _, tt := range tests {
+		if got := Len(tt.in); got != tt.want {
+			t.Errorf("Len(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCut(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         string
+		limit      int
+		head, tail string
+	}{
+		{"fits", "short text", 20, "short text", ""},
+		{"paragraph", "first paragraph\n\nsecond one", 24, "first paragraph\n\n", "second one"},
+		{"line", "first line\nsecond line", 16, "first line\n", "second line"},
+		{"word", "some words here!", 15, "some words ", "here!"},
+		{"no boundary", "abcdefghij", 8, "abcd", "efghij"},
+		{"surrogate pair", "😀😀😀😀😀", 9, "😀😀", "😀😀😀"},
+		{"code block", "```go\nline one\nline two\n```", 24, "```go\nline one\n```", "```go\nline two\n```"},
+		{"closed code block", "```\na\n```\ntext and more text", 20, "```\na\n```\n", "text and more text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, tail := Cut(tt.in, tt.limit)
+			if head != tt.head || tail != tt.tail {
+				t.Errorf("Cut(%q, %d) = %q, %q, want %q, %q", tt.in, tt.limit, head, tail, tt.head, tt.tail)
+			}
+		})
+	}
+}
+
+func TestSplitCodeBlock(t *testing.T) {
+	const limit = 4096
+	code := strings.Repeat("fmt.Println(\"a < b\")\n", 500)
+	text := "Here is the code:\n\n```go\n" + code + "```\nDone."
+
+	parts := Split(text, limit)
+	if len(parts) < 3 {
+		t.Fatalf("got %d parts, want at least 3", len(parts))
+	}
+
+	var joined strings.Builder
+	for i, part := range parts {
+		if n := Len(part); n > limit {
+			t.Errorf("part %d is %d long, over the limit", i, n)
+		}
+		if marker, _ := openBlock(part); marker != "" {
+			t.Errorf("part %d leaves a code block open", i)
+		}
+		if i > 0 && !strings.HasPrefix(part, "```go\n") {
+			t.Errorf("part %d does not reopen the code block: %q", i, part[:10])
+		}
+
+		html := ToHTML(part)
+		if strings.Count(html, "<pre>") != strings.Count(html, "</pre>") {
+			t.Errorf("part %d has unbalanced pre tags", i)
+		}
+		if strings.Contains(html, "```") {
+			t.Errorf("part %d renders a fence as text", i)
+		}
+
+		// strip the fences added by the split to get the code back
+		if i > 0 {
+			part = strings.TrimPrefix(part, "```go\n")
+		}
+		if i < len(parts)-1 {
+			part = strings.TrimSuffix(part, "\n```")
+			part += "\n"
+		}
+		joined.WriteString(part)
+	}
+
+	if !strings.Contains(joined.String(), code) {
+		t.Error("code lost in the split")
+	}
+}
+
+func TestSplitProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		limit int
+	}{
+		{"long fence", "```" + strings.Repeat("x", 2100) + "\n" + strings.Repeat("word ", 1000), 4096},
+		{"nested fences", "````>|](~~x\n\n] ~<__```😀\n\n````go\n```]", 26},
+		{"tiny limit", "```go\ncode\n```", 1},
+		{"surrogate pair over the limit", "😀😀", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan []string)
+			go func() { done <- Split(tt.in, tt.limit) }()
+
+			select {
+			case parts := <-done:
+				if len(parts) == 0 {
+					t.Fatal("no parts")
+				}
+				for i, part := range parts {
+					if part == "" {
+						t.Errorf("part %d is empty", i)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Split does not return")
+			}
+		})
+	}
+}
+
+func TestCutProgress(t *testing.T) {
+	in := "````>|](~~x\n\n] ~<__```😀\n\n````go\n```]"
+	for limit := 1; limit < Len(in); limit++ {
+		text := in
+		for text != "" {
+			_, tail := Cut(text, limit)
+			if Len(tail) >= Len(text) {
+				t.Fatalf("Cut(%q, %d) made no progress", text, limit)
+			}
+			text = tail
+		}
+	}
+}
@@ -61,6 +61,11 @@ type ChatCompletionResponse struct {
 	Usage   Usage                  `json:"usage"`
 }
 
+// ChatCompletionSupportsModel reports whether the model may be used with CreateChatCompletion.
+func ChatCompletionSupportsModel(model string) bool {
+	return checkEndpointSupportsModel("/chat/completions", model)
+}
+
 // CreateChatCompletion — API call to Create a completion for the chat message.
 func (c *Client) CreateChatCompletion(
 	ctx context.Context,
@@ -3,7 +3,6 @@ package openai
 import (
 	"bufio"
 	"context"
-	"net/http"
 )
 
 type ChatCompletionStreamChoiceDelta struct {
@@ -51,13 +50,10 @@ func (c *Client) CreateChatCompletionStream(
 		return
 	}
 
-	resp, err := c.config.HTTPClient.Do(req) //nolint:bodyclose // body is closed in stream.Close()
+	resp, credential, err := c.do(req) //nolint:bodyclose // body is closed in stream.Close()
 	if err != nil {
 		return
 	}
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return nil, c.handleErrorResp(resp)
-	}
 
 	stream = &ChatCompletionStream{
 		streamReader: &streamReader[ChatCompletionStreamResponse]{
@@ -66,6 +62,8 @@ func (c *Client) CreateChatCompletionStream(
 			response:           resp,
 			errAccumulator:     newErrorAccumulator(),
 			unmarshaler:        &jsonUnmarshaler{},
+			pool:               c.config.Credentials,
+			credential:         credential,
 		},
 	}
 	return
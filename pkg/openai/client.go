@@ -65,18 +65,20 @@ func (c *Client) sendRequest(req *http.Request, v any) error {
 		req.Header.Set("OpenAI-Organization", c.config.OrgID)
 	}
 
-	res, err := c.config.HTTPClient.Do(req)
+	res, credential, err := c.do(req)
 	if err != nil {
 		return err
 	}
 
 	defer res.Body.Close()
 
-	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusBadRequest {
-		return c.handleErrorResp(res)
+	if err := decodeResponse(res.Body, v); err != nil {
+		return err
 	}
-
-	return decodeResponse(res.Body, v)
+	if r, ok := v.(interface{ usage() Usage }); ok {
+		c.config.Credentials.addUsage(credential, r.usage())
+	}
+	return nil
 }
 
 func decodeResponse(body io.Reader, v any) error {
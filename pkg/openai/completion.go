@@ -23,6 +23,7 @@ const (
 	GPT4                    = "gpt-4"
 	GPT3Dot5Turbo0301       = "gpt-3.5-turbo-0301"
 	GPT3Dot5Turbo           = "gpt-3.5-turbo"
+	GPT3Dot5TurboInstruct   = "gpt-3.5-turbo-instruct"
 	GPT3TextDavinci003      = "text-davinci-003"
 	GPT3TextDavinci002      = "text-davinci-002"
 	GPT3TextCurie001        = "text-curie-001"
@@ -59,6 +60,7 @@ var disabledModelsForEndpoints = map[string]map[string]bool{
 		CodexCodeDavinci002:     true,
 		CodexCodeCushman001:     true,
 		CodexCodeDavinci001:     true,
+		GPT3Dot5TurboInstruct:   true,
 		GPT3TextDavinci003:      true,
 		GPT3TextDavinci002:      true,
 		GPT3TextCurie001:        true,
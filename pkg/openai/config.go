@@ -32,7 +32,9 @@ type ClientConfig struct {
 	APIVersion string // required when APIType is APITypeAzure or APITypeAzureAD
 	Engine     string // required when APIType is APITypeAzure or APITypeAzureAD
 
-	HTTPClient *http.Client
+	HTTPClient  *http.Client
+	Retry       RetryPolicy
+	Credentials *CredentialPool // used instead of the auth token and OrgID if set
 
 	EmptyMessagesLimit uint
 }
@@ -45,6 +47,7 @@ func DefaultConfig(authToken string) ClientConfig {
 		OrgID:     "",
 
 		HTTPClient: &http.Client{},
+		Retry:      DefaultRetryPolicy(),
 
 		EmptyMessagesLimit: defaultEmptyMessagesLimit,
 	}
@@ -60,6 +63,7 @@ func DefaultAzureConfig(apiKey, baseURL, engine string) ClientConfig {
 		Engine:     engine,
 
 		HTTPClient: &http.Client{},
+		Retry:      DefaultRetryPolicy(),
 
 		EmptyMessagesLimit: defaultEmptyMessagesLimit,
 	}
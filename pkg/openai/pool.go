@@ -0,0 +1,270 @@
+package openai
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential selection strategies of a CredentialPool.
+const (
+	SelectRoundRobin = "round-robin"
+	SelectLeastUsed  = "least-used"
+)
+
+// Credential is an API key with its organization and, optionally, endpoint.
+type Credential struct {
+	Name    string `json:",omitempty"` // shown in stats, a masked key if empty
+	Key     string
+	OrgID   string `json:",omitempty"`
+	BaseURL string `json:",omitempty"` // ClientConfig.BaseURL if empty
+}
+
+// CredentialStats is the usage of a credential.
+type CredentialStats struct {
+	Name             string
+	Requests         int64 // requests sent, retries included
+	Failures         int64 // error responses and connection errors
+	InFlight         int
+	PromptTokens     int64
+	CompletionTokens int64
+	SidelinedUntil   time.Time // zero if the credential is in use
+	LastError        string
+}
+
+// CredentialPool spreads requests of a client over several credentials.
+// Credentials rejected with 401, rate limits or exhausted quotas are
+// sidelined for a while and the request is sent again with another one.
+type CredentialPool struct {
+	Strategy          string        // SelectRoundRobin or SelectLeastUsed
+	AuthCooldown      time.Duration // how long a rejected key is not used
+	QuotaCooldown     time.Duration // how long a key with an exhausted quota is not used
+	RateLimitCooldown time.Duration // how long a rate limited key is not used, unless the server tells
+
+	mutex   sync.Mutex
+	entries []*poolEntry
+	next    int
+}
+
+type poolEntry struct {
+	Credential
+	stats CredentialStats
+}
+
+// NewCredentialPool creates a pool selecting credentials with the strategy.
+func NewCredentialPool(strategy string, credentials ...Credential) *CredentialPool {
+	p := &CredentialPool{
+		Strategy:          strategy,
+		AuthCooldown:      time.Hour,
+		QuotaCooldown:     time.Hour,
+		RateLimitCooldown: time.Minute,
+	}
+	for _, c := range credentials {
+		p.Add(c)
+	}
+	return p
+}
+
+// Add adds the credential to the pool.
+func (p *CredentialPool) Add(c Credential) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e := &poolEntry{Credential: c}
+	e.stats.Name = c.Name
+	if e.stats.Name == "" {
+		e.stats.Name = maskKey(c.Key)
+	}
+	p.entries = append(p.entries, e)
+}
+
+// Len returns the number of credentials.
+func (p *CredentialPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.entries)
+}
+
+// Stats returns the usage of every credential, in the order they were added.
+func (p *CredentialPool) Stats() []CredentialStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	stats := make([]CredentialStats, len(p.entries))
+	for i, e := range p.entries {
+		stats[i] = e.stats
+		if stats[i].SidelinedUntil.Before(now) {
+			stats[i].SidelinedUntil = time.Time{}
+		}
+	}
+	return stats
+}
+
+// acquire selects a credential for a request. When all of them are
+// sidelined, the one available first is used.
+func (p *CredentialPool) acquire() *poolEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var selected *poolEntry
+	for i := range p.entries {
+		// round robin checks entries starting after the last selected one
+		e := p.entries[(p.next+i)%len(p.entries)]
+		switch {
+		case selected == nil:
+			selected = e
+		case e.stats.SidelinedUntil.After(now) || selected.stats.SidelinedUntil.After(now):
+			if e.stats.SidelinedUntil.Before(selected.stats.SidelinedUntil) {
+				selected = e
+			}
+		case p.Strategy == SelectLeastUsed && e.less(selected):
+			selected = e
+		}
+	}
+
+	for i, e := range p.entries {
+		if e == selected {
+			p.next = i + 1
+		}
+	}
+	selected.stats.Requests++
+	selected.stats.InFlight++
+	return selected
+}
+
+func (e *poolEntry) less(other *poolEntry) bool {
+	if e.stats.InFlight != other.stats.InFlight {
+		return e.stats.InFlight < other.stats.InFlight
+	}
+	return e.stats.Requests < other.stats.Requests
+}
+
+// available reports whether a credential which is not sidelined is left.
+func (p *CredentialPool) available() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for _, e := range p.entries {
+		if !e.stats.SidelinedUntil.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// release records the result of a request, err is the error returned for the
+// response with the header, or the connection error. It reports whether the
+// credential was sidelined.
+func (p *CredentialPool) release(e *poolEntry, header http.Header, err error) bool {
+	if e == nil {
+		return false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e.stats.InFlight--
+	if err == nil {
+		return false
+	}
+	e.stats.Failures++
+	e.stats.LastError = err.Error()
+
+	cooldown := p.cooldown(header, err)
+	if cooldown <= 0 {
+		return false
+	}
+	e.stats.SidelinedUntil = time.Now().Add(cooldown)
+	return true
+}
+
+// cooldown returns how long the credential is not used after the error, 0 if
+// the error is not caused by the credential.
+func (p *CredentialPool) cooldown(header http.Header, err error) time.Duration {
+	code := 0
+	var apiErr *APIError
+	var reqErr *RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		code = apiErr.HTTPStatusCode
+		if apiErr.Type == "insufficient_quota" || apiErr.Code == "insufficient_quota" {
+			return p.QuotaCooldown
+		}
+	case errors.As(err, &reqErr):
+		code = reqErr.HTTPStatusCode
+	}
+
+	switch code {
+	case http.StatusUnauthorized:
+		return p.AuthCooldown
+	case http.StatusTooManyRequests:
+		if d := retryAfter(header); d > 0 {
+			return d
+		}
+		return p.RateLimitCooldown
+	}
+	return 0
+}
+
+// addUsage adds the tokens to the stats of the credential.
+func (p *CredentialPool) addUsage(e *poolEntry, u Usage) {
+	if p == nil || e == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e.stats.PromptTokens += int64(u.PromptTokens)
+	e.stats.CompletionTokens += int64(u.CompletionTokens)
+}
+
+func (r *ChatCompletionResponse) usage() Usage { return r.Usage }
+func (r *CompletionResponse) usage() Usage     { return r.Usage }
+func (r *EditsResponse) usage() Usage          { return r.Usage }
+func (r *EmbeddingResponse) usage() Usage      { return r.Usage }
+
+// setCredential authenticates the request with the credential and sends it
+// to its endpoint, target is the URL the request was built for.
+func (c *Client) setCredential(req *http.Request, target *url.URL, e *poolEntry) error {
+	if c.config.APIType == APITypeAzure {
+		req.Header.Set(AzureAPIKeyHeader, e.Key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+e.Key)
+	}
+	req.Header.Del("OpenAI-Organization")
+	if e.OrgID != "" {
+		req.Header.Set("OpenAI-Organization", e.OrgID)
+	}
+
+	base := strings.TrimRight(c.config.BaseURL, "/")
+	u := target
+	if e.BaseURL != "" && strings.HasPrefix(target.String(), base) {
+		var err error
+		u, err = url.Parse(strings.TrimRight(e.BaseURL, "/") + strings.TrimPrefix(target.String(), base))
+		if err != nil {
+			return err
+		}
+	}
+	req.URL, req.Host = u, u.Host
+	return nil
+}
+
+// maskKey shows only the ends of the key, "sk-…abcd".
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "…"
+	}
+	return key[:3] + "…" + key[len(key)-4:]
+}
@@ -0,0 +1,205 @@
+package openai
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures retries of requests failed with rate limits, server
+// errors or connection failures.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first one, 0 or 1 disables retries
+	MinBackoff  time.Duration // delay before the first retry, doubled with every next one
+	MaxBackoff  time.Duration // longest delay; a request the server asks to delay longer fails
+	Jitter      float64       // random part of the delay, 0.2 is up to 20%
+}
+
+// DefaultRetryPolicy makes 3 attempts, waiting about 1 and 2 seconds between them.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Second,
+		MaxBackoff:  30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+var (
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex sync.Mutex
+)
+
+// delay returns how long to wait before the retry following the attempt, and
+// false if the request must not be retried. serverDelay is the delay the
+// server asked for, 0 if none.
+func (p RetryPolicy) delay(attempt int, serverDelay time.Duration) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	jitterMutex.Lock()
+	r := jitterRand.Float64()
+	jitterMutex.Unlock()
+
+	if serverDelay > 0 {
+		if p.MaxBackoff > 0 && serverDelay > p.MaxBackoff {
+			return 0, false
+		}
+		// never earlier than asked
+		return serverDelay + time.Duration(float64(serverDelay)*p.Jitter*r), true
+	}
+
+	d := p.MinBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d + time.Duration(float64(d)*p.Jitter*(2*r-1)), true
+}
+
+// do sends the request, retrying it according to the retry policy. Error
+// responses are returned as errors, otherwise the caller closes the body.
+// With a credential pool every attempt selects a credential, and a request
+// rejected because of its credential is sent again at once with another one.
+func (c *Client) do(req *http.Request) (*http.Response, *poolEntry, error) {
+	pool := c.config.Credentials
+	target := req.URL
+	failovers := 0
+	for attempt := 1; ; attempt++ {
+		var entry *poolEntry
+		if pool != nil {
+			entry = pool.acquire()
+		}
+		if entry != nil {
+			if err := c.setCredential(req, target, entry); err != nil {
+				pool.release(entry, nil, nil)
+				return nil, nil, err
+			}
+		}
+
+		resp, err := c.config.HTTPClient.Do(req)
+		if err == nil && resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusBadRequest {
+			if pool != nil {
+				pool.release(entry, resp.Header, nil)
+			}
+			return resp, entry, nil
+		}
+
+		retryable, serverDelay, header := false, time.Duration(0), http.Header(nil)
+		if err != nil {
+			retryable = req.Context().Err() == nil && isRetryableNetError(req, err)
+		} else {
+			err = c.handleErrorResp(resp)
+			resp.Body.Close()
+			retryable = isRetryableStatus(resp.StatusCode, err)
+			serverDelay, header = retryAfter(resp.Header), resp.Header
+		}
+
+		wait, ok := time.Duration(0), false
+		if pool != nil && pool.release(entry, header, err) && failovers < pool.Len()-1 && pool.available() {
+			// failovers don't count as attempts
+			failovers++
+			attempt--
+			ok = true
+		} else if retryable {
+			wait, ok = c.config.Retry.delay(attempt, serverDelay)
+		}
+		if !ok {
+			return nil, nil, err
+		}
+
+		next := req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, nil, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, nil, err
+			}
+			next.Body = body
+		}
+		req = next
+
+		if wait == 0 {
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryableStatus reports whether the error response may succeed later.
+// Exhausted quotas don't, even though they come with 429.
+func isRetryableStatus(code int, err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.Type == "insufficient_quota" || apiErr.Code == "insufficient_quota") {
+		return false
+	}
+
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableNetError reports whether the failed request can be sent again
+// without doing the work twice: the connection was not established, or the
+// request is idempotent.
+func isRetryableNetError(req *http.Request, err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodDelete:
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+	return false
+}
+
+// retryAfter returns the delay the server asked for with the Retry-After
+// header, or the reset time of exhausted rate limits.
+func retryAfter(h http.Header) time.Duration {
+	if v := h.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t)
+		}
+	}
+
+	// e.g. x-ratelimit-remaining-tokens: 0, x-ratelimit-reset-tokens: 6m0s
+	var d time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if h.Get("X-Ratelimit-Remaining-"+limit) != "0" {
+			continue
+		}
+		if reset, err := time.ParseDuration(h.Get("X-Ratelimit-Reset-" + limit)); err == nil && reset > d {
+			d = reset
+		}
+	}
+	return d
+}
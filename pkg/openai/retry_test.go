@@ -0,0 +1,259 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	tests := []struct {
+		name        string
+		attempt     int
+		serverDelay time.Duration
+		want        time.Duration
+		ok          bool
+	}{
+		{"first retry", 1, 0, time.Second, true},
+		{"doubled", 2, 0, 2 * time.Second, true},
+		{"doubled again", 3, 0, 4 * time.Second, true},
+		{"capped", 4, 0, 5 * time.Second, true},
+		{"attempts exhausted", 5, 0, 0, false},
+		{"server delay", 1, 3 * time.Second, 3 * time.Second, true},
+		{"server delay too long", 1, time.Minute, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.delay(tt.attempt, tt.serverDelay)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("delay(%d, %s) = %s, %t, want %s, %t", tt.attempt, tt.serverDelay, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, MinBackoff: time.Second, MaxBackoff: time.Minute, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d, _ := p.delay(1, 0); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("backoff %s is out of the jitter range", d)
+		}
+		// never earlier than the server asked
+		if d, _ := p.delay(1, 10*time.Second); d < 10*time.Second || d > 12*time.Second {
+			t.Fatalf("server delay %s is out of the jitter range", d)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{"none", nil, 0},
+		{"seconds", map[string]string{"Retry-After": "7"}, 7 * time.Second},
+		{"invalid", map[string]string{"Retry-After": "soon"}, 0},
+		{"requests reset", map[string]string{
+			"X-Ratelimit-Remaining-Requests": "0", "X-Ratelimit-Reset-Requests": "1.5s",
+		}, 1500 * time.Millisecond},
+		{"longest exhausted reset", map[string]string{
+			"X-Ratelimit-Remaining-Requests": "0", "X-Ratelimit-Reset-Requests": "20ms",
+			"X-Ratelimit-Remaining-Tokens": "0", "X-Ratelimit-Reset-Tokens": "6m0s",
+		}, 6 * time.Minute},
+		{"limit not exhausted", map[string]string{
+			"X-Ratelimit-Remaining-Tokens": "100", "X-Ratelimit-Reset-Tokens": "6m0s",
+		}, 0},
+		{"retry-after wins", map[string]string{
+			"Retry-After": "2", "X-Ratelimit-Remaining-Tokens": "0", "X-Ratelimit-Reset-Tokens": "6m0s",
+		}, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			if got := retryAfter(h); got != tt.want {
+				t.Errorf("retryAfter() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got := retryAfter(h); got < 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter() of an HTTP date = %s, want about a minute", got)
+	}
+}
+
+// response is a canned response of the test server.
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+const chatResponse = `{"id":"1","choices":[{"message":{"role":"assistant","content":"hi"}}]}`
+
+// retryServer answers with the responses in turn and records request bodies.
+func retryServer(t *testing.T, responses []response) (*Client, *[]string) {
+	t.Helper()
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) > len(responses) {
+			t.Errorf("unexpected request %d", len(bodies))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := responses[len(bodies)-1]
+		for k, v := range resp.header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.status)
+		io.WriteString(w, resp.body)
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultConfig("test")
+	config.BaseURL = server.URL
+	config.Retry = RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second}
+	return NewClientWithConfig(config), &bodies
+}
+
+var chatRequest = ChatCompletionRequest{
+	Model:    GPT3Dot5Turbo,
+	Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: "hello"}},
+}
+
+func TestRetries(t *testing.T) {
+	rateLimited := `{"error":{"message":"slow down","type":"requests"}}`
+	noQuota := `{"error":{"message":"no quota","type":"insufficient_quota"}}`
+
+	tests := []struct {
+		name      string
+		responses []response
+		requests  int
+		status    int // of the returned error, 0 for success
+	}{
+		{"retry after", []response{
+			{http.StatusTooManyRequests, map[string]string{"Retry-After": "1"}, rateLimited},
+			{http.StatusOK, nil, chatResponse},
+		}, 2, 0},
+		{"server error then success", []response{
+			{http.StatusBadGateway, nil, ""},
+			{http.StatusOK, nil, chatResponse},
+		}, 2, 0},
+		{"attempts exhausted", []response{
+			{http.StatusServiceUnavailable, nil, ""},
+			{http.StatusServiceUnavailable, nil, ""},
+			{http.StatusServiceUnavailable, nil, ""},
+		}, 3, http.StatusServiceUnavailable},
+		{"insufficient quota", []response{
+			{http.StatusTooManyRequests, nil, noQuota},
+		}, 1, http.StatusTooManyRequests},
+		{"bad request", []response{
+			{http.StatusBadRequest, nil, `{"error":{"message":"bad","type":"invalid_request_error"}}`},
+		}, 1, http.StatusBadRequest},
+		{"wait too long", []response{
+			{http.StatusTooManyRequests, map[string]string{"Retry-After": "60"}, rateLimited},
+		}, 1, http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, bodies := retryServer(t, tt.responses)
+
+			_, err := client.CreateChatCompletion(context.Background(), chatRequest)
+			if tt.status == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.status != 0 {
+				var apiErr *APIError
+				var reqErr *RequestError
+				switch {
+				case errors.As(err, &apiErr) && apiErr.HTTPStatusCode == tt.status:
+				case errors.As(err, &reqErr) && reqErr.HTTPStatusCode == tt.status:
+				default:
+					t.Fatalf("got error %v, want status %d", err, tt.status)
+				}
+			}
+
+			if len(*bodies) != tt.requests {
+				t.Fatalf("got %d requests, want %d", len(*bodies), tt.requests)
+			}
+			// the POST body is sent again with every retry
+			for i, body := range *bodies {
+				if body == "" || body != (*bodies)[0] {
+					t.Errorf("body of request %d = %q, want %q", i+1, body, (*bodies)[0])
+				}
+			}
+		})
+	}
+}
+
+func TestRetriesDisabled(t *testing.T) {
+	for _, attempts := range []int{0, 1} {
+		client, bodies := retryServer(t, []response{
+			{http.StatusServiceUnavailable, nil, ""},
+		})
+		client.config.Retry.MaxAttempts = attempts
+
+		if _, err := client.CreateChatCompletion(context.Background(), chatRequest); err == nil {
+			t.Errorf("MaxAttempts %d: got no error", attempts)
+		}
+		if len(*bodies) != 1 {
+			t.Errorf("MaxAttempts %d: got %d requests, want 1", attempts, len(*bodies))
+		}
+	}
+}
+
+func TestRetryStream(t *testing.T) {
+	client, bodies := retryServer(t, []response{
+		{http.StatusServiceUnavailable, nil, ""},
+		{http.StatusOK, map[string]string{"Content-Type": "text/event-stream"}, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"},
+	})
+
+	stream, err := client.CreateChatCompletionStream(context.Background(), chatRequest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer stream.Close()
+
+	resp, err := stream.Recv()
+	if err != nil || len(resp.Choices) == 0 || resp.Choices[0].Delta.Content != "hi" {
+		t.Fatalf("Recv() = %+v, %v", resp, err)
+	}
+	if len(*bodies) != 2 {
+		t.Errorf("got %d requests, want 2", len(*bodies))
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	client, bodies := retryServer(t, []response{
+		{http.StatusTooManyRequests, map[string]string{"Retry-After": "1"}, `{"error":{"message":"slow down","type":"requests"}}`},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.CreateChatCompletion(ctx, chatRequest); err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("the retry did not stop when the context was canceled")
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("got %d requests, want 1", len(*bodies))
+	}
+}
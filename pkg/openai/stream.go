@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"errors"
-	"net/http"
 )
 
 var (
@@ -40,13 +39,10 @@ func (c *Client) CreateCompletionStream(
 		return
 	}
 
-	resp, err := c.config.HTTPClient.Do(req) //nolint:bodyclose // body is closed in stream.Close()
+	resp, credential, err := c.do(req) //nolint:bodyclose // body is closed in stream.Close()
 	if err != nil {
 		return
 	}
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-		return nil, c.handleErrorResp(resp)
-	}
 
 	stream = &CompletionStream{
 		streamReader: &streamReader[CompletionResponse]{
@@ -55,6 +51,8 @@ func (c *Client) CreateCompletionStream(
 			response:           resp,
 			errAccumulator:     newErrorAccumulator(),
 			unmarshaler:        &jsonUnmarshaler{},
+			pool:               c.config.Credentials,
+			credential:         credential,
 		},
 	}
 	return
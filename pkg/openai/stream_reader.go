@@ -20,6 +20,9 @@ type streamReader[T streamable] struct {
 	response       *http.Response
 	errAccumulator errorAccumulator
 	unmarshaler    unmarshaler
+
+	pool       *CredentialPool
+	credential *poolEntry
 }
 
 func (stream *streamReader[T]) Recv() (response T, err error) {
@@ -67,6 +70,12 @@ waitForData:
 	return
 }
 
+// AddUsage counts tokens to the credential the stream was created with.
+// Streamed responses carry no usage, so the caller counts them.
+func (stream *streamReader[T]) AddUsage(u Usage) {
+	stream.pool.addUsage(stream.credential, u)
+}
+
 func (stream *streamReader[T]) Close() {
 	stream.response.Body.Close()
 }
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const sessionFileExt = ".json"
+
+// FileStore keeps every session in its own JSON file inside a directory.
+// Files are replaced atomically, so a crash never leaves a half-written session.
+type FileStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %w", err)
+	}
+
+	return &FileStore{
+		dir: dir,
+	}, nil
+}
+
+func (f *FileStore) filename(telegramID int64) string {
+	return filepath.Join(f.dir, strconv.FormatInt(telegramID, 10)+sessionFileExt)
+}
+
+func (f *FileStore) Load(telegramID int64) (*Session, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.load(f.filename(telegramID))
+}
+
+func (f *FileStore) load(filename string) (*Session, error) {
+	buf, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Session
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", filename, err)
+	}
+	return &s, nil
+}
+
+func (f *FileStore) LoadAll() ([]*Session, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), sessionFileExt) {
+			continue
+		}
+
+		s, err := f.load(filepath.Join(f.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func (f *FileStore) Save(session *Session) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	tmp, err := os.CreateTemp(f.dir, "session-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.filename(session.TelegramID))
+}
+
+func (f *FileStore) Delete(telegramID int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err := os.Remove(f.filename(telegramID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *FileStore) Close() error {
+	return nil
+}
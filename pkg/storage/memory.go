@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"sync"
+)
+
+// MemoryStore keeps sessions in memory only, they are lost on restart.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	sessions map[int64]*Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[int64]*Session),
+	}
+}
+
+func (m *MemoryStore) Load(telegramID int64) (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.sessions[telegramID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return clone(s), nil
+}
+
+func (m *MemoryStore) LoadAll() ([]*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, clone(s))
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) Save(session *Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sessions[session.TelegramID] = clone(session)
+	return nil
+}
+
+func (m *MemoryStore) Delete(telegramID int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, telegramID)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
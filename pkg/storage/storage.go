@@ -0,0 +1,97 @@
+// Package storage persists user sessions of the bot.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"chatgptbot/pkg/openai"
+)
+
+// Storage types supported by New.
+const (
+	TypeMemory = "memory"
+	TypeFile   = "file"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a conversation of a user together with the user preferences.
+type Session struct {
+	TelegramID     int64
+	ChatID         int64 `json:",omitempty"` // chat of the last exchange, differs from TelegramID in groups
+	LastActiveTime time.Time
+	HistoryMessage []openai.ChatCompletionMessage
+	Summary        string `json:",omitempty"` // summary of turns trimmed from HistoryMessage
+	Settings       Settings
+	Quota          Quota
+}
+
+// Quota counts what the user consumed against the usage limits.
+type Quota struct {
+	Day         string `json:",omitempty"` // day of the daily counters, 2006-01-02
+	TokensToday int    `json:",omitempty"`
+	ImagesToday int    `json:",omitempty"`
+	Month       string `json:",omitempty"` // month of TokensMonth, 2006-01
+	TokensMonth int    `json:",omitempty"`
+}
+
+// Settings are per-user preferences overriding the bot defaults.
+// Empty values mean the default is used.
+type Settings struct {
+	Temperature    *float32          `json:",omitempty"`
+	Model          string            `json:",omitempty"`
+	Persona        string            `json:",omitempty"` // name of the selected persona
+	CustomPersonas map[string]string `json:",omitempty"` // user-defined personas by name
+	Stream         *bool             `json:",omitempty"`
+	Language       string            `json:",omitempty"` // code of the answer language
+}
+
+// Store keeps sessions between bot restarts.
+type Store interface {
+	// Load returns the session of the user or ErrSessionNotFound.
+	Load(telegramID int64) (*Session, error)
+	// LoadAll returns all stored sessions.
+	LoadAll() ([]*Session, error)
+	// Save creates or replaces the session.
+	Save(session *Session) error
+	// Delete removes the session of the user, if any.
+	Delete(telegramID int64) error
+	// Close flushes pending data and releases resources.
+	Close() error
+}
+
+// New creates a store of the given type. For file stores path is a directory
+// which is created if it does not exist.
+func New(storeType, path string) (Store, error) {
+	switch storeType {
+	case TypeMemory, "":
+		return NewMemoryStore(), nil
+	case TypeFile:
+		return NewFileStore(path)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", storeType)
+	}
+}
+
+// clone returns a deep copy of the session, so stored sessions are not shared with callers.
+func clone(s *Session) *Session {
+	c := *s
+	c.HistoryMessage = append([]openai.ChatCompletionMessage(nil), s.HistoryMessage...)
+	if s.Settings.Temperature != nil {
+		t := *s.Settings.Temperature
+		c.Settings.Temperature = &t
+	}
+	if s.Settings.Stream != nil {
+		stream := *s.Settings.Stream
+		c.Settings.Stream = &stream
+	}
+	if s.Settings.CustomPersonas != nil {
+		c.Settings.CustomPersonas = make(map[string]string, len(s.Settings.CustomPersonas))
+		for name, prompt := range s.Settings.CustomPersonas {
+			c.Settings.CustomPersonas[name] = prompt
+		}
+	}
+	return &c
+}
@@ -0,0 +1,59 @@
+package tokenizer
+
+import (
+	"strings"
+
+	"chatgptbot/pkg/openai"
+)
+
+const defaultContextWindow = 4096
+
+// contextWindows maps model name prefixes to their context size in tokens.
+// Longer prefixes go first, so the most specific one matches.
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4-1106", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo-1106", 16385},
+	{"gpt-3.5-turbo-16k", 16384},
+	{"gpt-3.5-turbo", 4096},
+}
+
+// ContextWindow returns the number of tokens the model accepts for the prompt
+// and the completion together.
+func ContextWindow(model string) int {
+	for _, w := range contextWindows {
+		if strings.HasPrefix(model, w.prefix) {
+			return w.tokens
+		}
+	}
+	return defaultContextWindow
+}
+
+// CountMessages returns the number of prompt tokens of a chat request, following
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+func CountMessages(e *Encoding, model string, messages []openai.ChatCompletionMessage) int {
+	tokensPerMessage, tokensPerName := 3, 1
+	if model == openai.GPT3Dot5Turbo0301 {
+		// every message follows <|start|>{role/name}\n{content}<|end|>\n
+		tokensPerMessage, tokensPerName = 4, -1
+	}
+
+	var count int
+	for _, m := range messages {
+		count += tokensPerMessage
+		count += e.Count(m.Role)
+		count += e.Count(m.Content)
+		if m.Name != "" {
+			count += e.Count(m.Name)
+			count += tokensPerName
+		}
+	}
+
+	// every reply is primed with <|start|>assistant<|message|>
+	return count + 3
+}
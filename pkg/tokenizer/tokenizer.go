@@ -0,0 +1,197 @@
+// Package tokenizer counts tokens of prompts sent to OpenAI models.
+//
+// Encoding implements the byte pair encoding used by tiktoken, so it produces
+// the same tokens as the cl100k_base encoding of gpt-3.5-turbo and gpt-4 when
+// loaded with the cl100k_base.tiktoken rank file. A nil *Encoding estimates
+// token counts instead, which is good enough for context trimming.
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cl100kPattern splits text into pieces which are encoded independently.
+// The original pattern ends with `\s+(?!\S)|\s+`, Go regexp has no lookahead,
+// so the trailing whitespace rule is applied in split.
+var cl100kPattern = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Encoding is a byte pair encoding defined by token ranks.
+type Encoding struct {
+	ranks map[string]int
+}
+
+// LoadEncoding reads ranks in the tiktoken format: one base64 encoded token
+// and its rank per line.
+func LoadEncoding(r io.Reader) (*Encoding, error) {
+	e := &Encoding{
+		ranks: make(map[string]int),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rank line: %q", line)
+		}
+
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token %q: %w", fields[0], err)
+		}
+
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank %q: %w", fields[1], err)
+		}
+
+		e.ranks[string(token)] = rank
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LoadEncodingFile reads ranks from a tiktoken file, e.g. cl100k_base.tiktoken.
+func LoadEncodingFile(path string) (*Encoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadEncoding(f)
+}
+
+// Encode returns the tokens of the text. A nil Encoding returns no tokens.
+func (e *Encoding) Encode(text string) []int {
+	if e == nil {
+		return nil
+	}
+
+	var tokens []int
+	for _, piece := range split(text) {
+		tokens = append(tokens, e.bytePairEncode([]byte(piece))...)
+	}
+	return tokens
+}
+
+// Count returns the number of tokens of the text. A nil Encoding estimates it.
+func (e *Encoding) Count(text string) int {
+	if e == nil {
+		return Estimate(text)
+	}
+	return len(e.Encode(text))
+}
+
+// bytePairEncode merges the lowest ranked adjacent parts of the piece until
+// no more merges are possible.
+func (e *Encoding) bytePairEncode(piece []byte) []int {
+	if rank, ok := e.ranks[string(piece)]; ok {
+		return []int{rank}
+	}
+
+	// parts holds start offsets of the parts, the last one is len(piece)
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+
+	for len(parts) > 2 {
+		minRank, minIndex := -1, -1
+		for i := 0; i < len(parts)-2; i++ {
+			rank, ok := e.ranks[string(piece[parts[i]:parts[i+2]])]
+			if ok && (minRank < 0 || rank < minRank) {
+				minRank, minIndex = rank, i
+			}
+		}
+		if minIndex < 0 {
+			break
+		}
+		parts = append(parts[:minIndex+1], parts[minIndex+2:]...)
+	}
+
+	tokens := make([]int, 0, len(parts)-1)
+	for i := 0; i < len(parts)-1; i++ {
+		if rank, ok := e.ranks[string(piece[parts[i]:parts[i+1]])]; ok {
+			tokens = append(tokens, rank)
+		}
+	}
+	return tokens
+}
+
+// split splits text into pieces following the cl100k_base pattern.
+func split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := cl100kPattern.FindStringIndex(text)
+		if loc == nil {
+			pieces = append(pieces, text)
+			break
+		}
+
+		end := loc[1]
+		match := text[loc[0]:end]
+		// `\s+(?!\S)`: whitespace followed by a non-space leaves its last
+		// character to the next piece.
+		if end < len(text) && isSpace(match) && !strings.HasSuffix(match, "\n") && !strings.HasSuffix(match, "\r") {
+			if _, size := utf8.DecodeLastRuneInString(match); size < len(match) {
+				end -= size
+			}
+		}
+
+		if loc[0] > 0 {
+			pieces = append(pieces, text[:loc[0]])
+		}
+		pieces = append(pieces, text[loc[0]:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+func isSpace(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Estimate approximates the token count of the text without ranks: short
+// ASCII words are usually one token, other scripts take about two characters
+// per token.
+func Estimate(text string) int {
+	var count int
+	for _, piece := range split(text) {
+		ascii, other := 0, 0
+		for _, r := range piece {
+			if r < utf8.RuneSelf {
+				ascii++
+			} else {
+				other++
+			}
+		}
+		n := (ascii+3)/4 + (other+1)/2
+		if n == 0 {
+			n = 1
+		}
+		count += n
+	}
+	return count
+}
@@ -0,0 +1,119 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRanks is a small hand-made rank table, lower ranks merge first.
+var testRanks = map[string]int{
+	"a": 0, "b": 1, "c": 2, " ": 7,
+	"ab": 3, "bc": 4, "abc": 5, "cb": 6, " ab": 8,
+}
+
+func loadTestEncoding(t *testing.T) *Encoding {
+	t.Helper()
+
+	var b strings.Builder
+	for token, rank := range testRanks {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	e, err := LoadEncoding(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestBytePairEncode(t *testing.T) {
+	e := loadTestEncoding(t)
+
+	tests := []struct {
+		piece string
+		want  []int
+	}{
+		{"a", []int{0}},
+		{"abc", []int{5}},       // a token itself
+		{"abcb", []int{5, 1}},   // ab, then abc
+		{"bcb", []int{4, 1}},    // bc ranks lower than cb
+		{"cbabc", []int{6, 5}},  // ab, abc, then cb
+		{"cab", []int{2, 3}},    // ca is no token
+		{"abab", []int{3, 3}},   // equal ranks merge leftmost first
+		{"ab ab", []int{3, 8}},  // ab, ab, then " ab"
+		{" abc", []int{7, 5}},   // abc ranks lower than " ab"
+		{"bbb", []int{1, 1, 1}}, // no merges
+		{"xa", []int{0}},        // bytes without a rank are skipped
+	}
+	for _, tt := range tests {
+		if got := e.bytePairEncode([]byte(tt.piece)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bytePairEncode(%q) = %v, want %v", tt.piece, got, tt.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	// pieces produced by tiktoken for cl100k_base
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello world", []string{"hello", " world"}},
+		{"Hello  world", []string{"Hello", " ", " world"}},
+		{"  hi", []string{" ", " hi"}},
+		{"hi  ", []string{"hi", "  "}},
+		{"123456789", []string{"123", "456", "789"}},
+		{"12345", []string{"123", "45"}},
+		{"abc123", []string{"abc", "123"}},
+		{"I'm here", []string{"I", "'m", " here"}},
+		{"don't", []string{"don", "'t"}},
+		{"WE'LL", []string{"WE", "'LL"}},
+		{"hello!!!", []string{"hello", "!!!"}},
+		{"a, b.", []string{"a", ",", " b", "."}},
+		{"a\nb", []string{"a", "\n", "b"}},
+		{"a\n\nb", []string{"a", "\n\n", "b"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+		{"a  \n  b", []string{"a", "  \n", " ", " b"}},
+		{"x\n    y", []string{"x", "\n", "   ", " y"}},
+		{"end.\n", []string{"end", ".\n"}},
+		{"привет мир", []string{"привет", " мир"}},
+		{"func main() {", []string{"func", " main", "()", " {"}},
+		{"$100", []string{"$", "100"}},
+		{"\tindent", []string{"\tindent"}},
+	}
+	for _, tt := range tests {
+		if got := split(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("split(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	e := loadTestEncoding(t)
+
+	// " ab" is a piece of its own, so "ab ab" is two pieces
+	if got, want := e.Encode("ab ab"), []int{3, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Encode() = %v, want %v", got, want)
+	}
+	if got := e.Count("abc abc"); got != 3 {
+		t.Errorf("Count() = %d, want 3", got)
+	}
+
+	var nilEncoding *Encoding
+	if got := nilEncoding.Encode("abc"); got != nil {
+		t.Errorf("nil Encode() = %v, want nil", got)
+	}
+	if got, want := nilEncoding.Count("hello world"), Estimate("hello world"); got != want {
+		t.Errorf("nil Count() = %d, want the estimate %d", got, want)
+	}
+}
+
+func TestLoadEncodingErrors(t *testing.T) {
+	for _, in := range []string{"YQ==", "!!! 1", "YQ== x"} {
+		if _, err := LoadEncoding(strings.NewReader(in)); err == nil {
+			t.Errorf("LoadEncoding(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package usage
+
+import "strings"
+
+// Price is the cost of a model in USD.
+type Price struct {
+	Prompt      float64 `json:",omitempty"` // per 1000 prompt tokens
+	Completion  float64 `json:",omitempty"` // per 1000 completion tokens
+	Image       float64 `json:",omitempty"` // per image
+	AudioMinute float64 `json:",omitempty"` // per minute of audio
+}
+
+// Pricing maps models, or model name prefixes, to prices.
+type Pricing map[string]Price
+
+// DefaultPricing lists the prices of the OpenAI models. Images are priced per
+// size as "dall-e-<size>".
+var DefaultPricing = Pricing{
+	"gpt-3.5-turbo":          {Prompt: 0.0015, Completion: 0.002},
+	"gpt-3.5-turbo-16k":      {Prompt: 0.003, Completion: 0.004},
+	"gpt-3.5-turbo-instruct": {Prompt: 0.0015, Completion: 0.002},
+	"gpt-4":                  {Prompt: 0.03, Completion: 0.06},
+	"gpt-4-32k":              {Prompt: 0.06, Completion: 0.12},
+	"whisper-1":              {AudioMinute: 0.006},
+	"dall-e-256x256":         {Image: 0.016},
+	"dall-e-512x512":         {Image: 0.018},
+	"dall-e-1024x1024":       {Image: 0.02},
+}
+
+// Merge returns the prices of p overridden by the prices of o.
+func (p Pricing) Merge(o Pricing) Pricing {
+	merged := make(Pricing, len(p)+len(o))
+	for model, price := range p {
+		merged[model] = price
+	}
+	for model, price := range o {
+		merged[model] = price
+	}
+	return merged
+}
+
+// Price returns the price of the model, matching dated versions such as
+// gpt-4-0613 by the longest known prefix.
+func (p Pricing) Price(model string) (Price, bool) {
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+
+	var best string
+	for name := range p {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return p[best], true
+}
+
+// Cost returns the cost of the usage of the model. Unknown models cost nothing.
+func (p Pricing) Cost(model string, t Totals) float64 {
+	price, _ := p.Price(model)
+	return float64(t.PromptTokens)/1000*price.Prompt +
+		float64(t.CompletionTokens)/1000*price.Completion +
+		float64(t.Images)*price.Image +
+		float64(t.AudioSeconds)/60*price.AudioMinute
+}
@@ -0,0 +1,210 @@
+// Package usage keeps a ledger of the OpenAI API usage of bot users.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record is a single use of the API.
+type Record struct {
+	Time             time.Time
+	UserID           int64
+	Model            string
+	PromptTokens     int `json:",omitempty"`
+	CompletionTokens int `json:",omitempty"`
+	Images           int `json:",omitempty"`
+	AudioSeconds     int `json:",omitempty"`
+}
+
+// Totals sums records.
+type Totals struct {
+	PromptTokens     int
+	CompletionTokens int
+	Images           int
+	AudioSeconds     int
+}
+
+func (t *Totals) Add(o Totals) {
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.Images += o.Images
+	t.AudioSeconds += o.AudioSeconds
+}
+
+// Tokens returns the prompt and completion tokens together.
+func (t Totals) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+// Key groups records by day, user and model.
+type Key struct {
+	Day    string // 2006-01-02
+	UserID int64
+	Model  string
+}
+
+// Row is the usage of a user with a model during a day.
+type Row struct {
+	Key
+	Totals
+}
+
+// Ledger sums usage by day, user and model. Records are appended to a JSON
+// lines file, so the ledger survives restarts.
+type Ledger struct {
+	mutex  sync.Mutex
+	file   *os.File
+	totals map[Key]*Totals
+}
+
+// Open reads the ledger file and opens it for appending. An empty path keeps
+// the ledger in memory only.
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{
+		totals: make(map[Key]*Totals),
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// A record torn by a crash can only be the last line, it is dropped.
+	// Undecodable lines followed by others are corruption.
+	var (
+		good    int64 // offset past the last decoded line
+		badErr  error
+		badLine int
+	)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if badErr != nil {
+			file.Close()
+			return nil, fmt.Errorf("decoding %s line %d: %w", path, badLine, badErr)
+		}
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			badErr, badLine = err, line
+			continue
+		}
+		l.add(r)
+		good += int64(len(scanner.Bytes())) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	switch {
+	case badErr != nil:
+		log.Printf("usage: dropping the partial record at line %d of %s: %v", badLine, path, badErr)
+		err = file.Truncate(good)
+	case good > info.Size():
+		// the last record misses its newline, the next one would join it
+		_, err = file.Write([]byte{'\n'})
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l.file = file
+	return l, nil
+}
+
+// Add writes the record to the ledger.
+func (l *Ledger) Add(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.add(r)
+	if l.file == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(buf, '\n'))
+	return err
+}
+
+func (l *Ledger) add(r Record) {
+	key := Key{Day: r.Time.Format("2006-01-02"), UserID: r.UserID, Model: r.Model}
+	t, ok := l.totals[key]
+	if !ok {
+		t = &Totals{}
+		l.totals[key] = t
+	}
+	t.Add(Totals{
+		PromptTokens:     r.PromptTokens,
+		CompletionTokens: r.CompletionTokens,
+		Images:           r.Images,
+		AudioSeconds:     r.AudioSeconds,
+	})
+}
+
+// Rows returns the usage of the days from since on, sorted by day, user and
+// model. The filter, if not nil, selects the rows.
+func (l *Ledger) Rows(since time.Time, filter func(Key) bool) []Row {
+	day := since.Format("2006-01-02")
+
+	l.mutex.Lock()
+	var rows []Row
+	for key, t := range l.totals {
+		if key.Day < day || (filter != nil && !filter(key)) {
+			continue
+		}
+		rows = append(rows, Row{Key: key, Totals: *t})
+	}
+	l.mutex.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.Model < b.Model
+	})
+	return rows
+}
+
+// Close flushes the ledger file.
+func (l *Ledger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
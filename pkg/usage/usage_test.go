@@ -0,0 +1,84 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	record1 = `{"Time":"2023-05-01T10:00:00Z","UserID":1,"Model":"gpt-3.5-turbo","PromptTokens":10,"CompletionTokens":5}`
+	record2 = `{"Time":"2023-05-01T11:00:00Z","UserID":1,"Model":"gpt-3.5-turbo","PromptTokens":20}`
+)
+
+func writeLedger(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tokens(l *Ledger) int {
+	var total Totals
+	for _, row := range l.Rows(time.Time{}, nil) {
+		total.Add(row.Totals)
+	}
+	return total.Tokens()
+}
+
+func TestOpenPartialRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		tokens  int
+	}{
+		{"complete", record1 + "\n" + record2 + "\n", 35},
+		{"torn last record", record1 + "\n" + record2[:30], 15},
+		{"last record without newline", record1 + "\n" + record2, 35},
+		{"empty", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeLedger(t, tt.content)
+
+			l, err := Open(path)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if got := tokens(l); got != tt.tokens {
+				t.Errorf("tokens = %d, want %d", got, tt.tokens)
+			}
+			// new records must follow a well-formed file
+			if err := l.Add(Record{UserID: 2, Model: "gpt-4", PromptTokens: 1}); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			l, err = Open(path)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer l.Close()
+			if got := tokens(l); got != tt.tokens+1 {
+				t.Errorf("tokens after reopening = %d, want %d", got, tt.tokens+1)
+			}
+		})
+	}
+}
+
+func TestOpenCorrupted(t *testing.T) {
+	path := writeLedger(t, record1+"\n"+record2[:30]+"\n"+record2+"\n")
+
+	l, err := Open(path)
+	if err == nil {
+		l.Close()
+		t.Fatal("Open of a ledger corrupted in the middle succeeded")
+	}
+}